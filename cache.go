@@ -0,0 +1,138 @@
+package reactor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// blobCache holds data derived from each version of server code loaded into a
+// Pool, such as V8 code cache data or startup snapshots, so that it is only
+// derived once. Callers deriving the data hold the lock of its version, so
+// that workers created at the same time wait for the first to derive it. If
+// dir is set, the data is also stored on disk in files named after the
+// version with the extension ext, so it survives process restarts.
+type blobCache struct {
+	dir  string
+	ext  string
+	data map[string][]byte
+	mu   sync.Mutex
+
+	// locks holds the lock of each version.
+	locks map[string]*sync.Mutex
+}
+
+func newBlobCache(dir, ext string) *blobCache {
+	return &blobCache{
+		dir:   dir,
+		ext:   ext,
+		data:  make(map[string][]byte),
+		locks: make(map[string]*sync.Mutex),
+	}
+}
+
+// lock locks the given version while its data is derived, returning a
+// function which unlocks it.
+func (c *blobCache) lock(version string) func() {
+	c.mu.Lock()
+	l, ok := c.locks[version]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[version] = l
+	}
+	c.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// get returns the data for the given version. The data may be empty if it
+// was found that none can be derived.
+func (c *blobCache) get(version string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if data, ok := c.data[version]; ok {
+		return data, true
+	}
+	if c.dir == "" {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(c.path(version))
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+	c.data[version] = data
+	return data, true
+}
+
+// put stores the data for the given version. Empty data is only kept in
+// memory. Failing to write to disk is not an error, as the cache only serves
+// to speed up startup.
+func (c *blobCache) put(version string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.data[version] = data
+	if c.dir == "" || len(data) == 0 {
+		return
+	}
+
+	// Write to a temporary file first so that other processes sharing the
+	// directory never read partially written data.
+	f, err := ioutil.TempFile(c.dir, version+".tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(version))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// remove discards the data for the given version, such as when V8 has
+// rejected it.
+func (c *blobCache) remove(version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.data, version)
+	if c.dir != "" {
+		os.Remove(c.path(version))
+	}
+}
+
+// retain discards the data held in memory for any version not in the given
+// list. Data stored on disk is kept.
+func (c *blobCache) retain(versions []*Version) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keep := make(map[string]bool, len(versions))
+	for _, v := range versions {
+		keep[v.ID] = true
+	}
+	for version := range c.data {
+		if !keep[version] {
+			delete(c.data, version)
+		}
+	}
+	for version := range c.locks {
+		if !keep[version] {
+			delete(c.locks, version)
+		}
+	}
+}
+
+// path returns the path of the file holding the data for the given version.
+func (c *blobCache) path(version string) string {
+	return filepath.Join(c.dir, version+c.ext)
+}
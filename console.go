@@ -0,0 +1,165 @@
+package reactor
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jcoene/reactor/v8"
+)
+
+// consoleScript installs a console object on the global object. Arguments are
+// formatted in JavaScript, like util.format in Node.js, and the resulting
+// line passed to write along with its level.
+const consoleScript = `(function(global, write) {
+	function inspect(value) {
+		if (typeof value === "string") {
+			return value;
+		}
+		if (value instanceof Error) {
+			return value.stack || String(value);
+		}
+		if (typeof value === "function") {
+			return "[Function" + (value.name ? ": " + value.name : "") + "]";
+		}
+		if (typeof value === "object" && value !== null) {
+			try {
+				return JSON.stringify(value);
+			} catch (e) {
+				return String(value);
+			}
+		}
+		return String(value);
+	}
+
+	function format(args) {
+		var parts = [];
+		var i = 0;
+		if (typeof args[0] === "string") {
+			i = 1;
+			parts.push(args[0].replace(/%[sdifjoO%]/g, function(spec) {
+				if (spec === "%%") {
+					return "%";
+				}
+				if (i >= args.length) {
+					return spec;
+				}
+				var arg = args[i++];
+				switch (spec) {
+				case "%s":
+					return inspect(arg);
+				case "%d":
+					return String(Number(arg));
+				case "%i":
+					return String(parseInt(arg, 10));
+				case "%f":
+					return String(parseFloat(arg));
+				case "%j":
+					try {
+						return JSON.stringify(arg);
+					} catch (e) {
+						return "[Circular]";
+					}
+				}
+				return inspect(arg);
+			}));
+		}
+		for (; i < args.length; i++) {
+			parts.push(inspect(args[i]));
+		}
+		return parts.join(" ");
+	}
+
+	function method(level) {
+		return function() {
+			write(level, format(arguments));
+		};
+	}
+
+	global.console = {
+		log: method("log"),
+		info: method("info"),
+		warn: method("warn"),
+		error: method("error"),
+		debug: method("debug"),
+	};
+})`
+
+// ConsoleMessage is a line written to the console by the server script.
+type ConsoleMessage struct {
+	// Level is the name of the console method called: "log", "info",
+	// "warn", "error" or "debug".
+	Level string `json:"level"`
+
+	// Message is the formatted line.
+	Message string `json:"message"`
+}
+
+// installConsole installs the console object in the worker's context, with
+// output handled by the worker's console method.
+func (w *Worker) installConsole() error {
+	install, err := w.ctx.Eval(consoleScript, "")
+	if err != nil {
+		return err
+	}
+	defer install.Release()
+
+	write, err := w.ctx.NewFunction(w.console)
+	if err != nil {
+		return err
+	}
+	defer write.Release()
+
+	global, err := w.ctx.Eval("this", "")
+	if err != nil {
+		return err
+	}
+	defer global.Release()
+
+	val, err := install.Call(global, write)
+	val.Release()
+	return err
+}
+
+// console is called by the server script with the level and message of each
+// line written to the console. It runs during a render, or while the server
+// script is loaded, so the worker lock is already held.
+func (w *Worker) console(args []*v8.Value) (*v8.Value, error) {
+	if len(args) != 2 {
+		return nil, nil
+	}
+	msg := ConsoleMessage{
+		Level:   args[0].String(),
+		Message: args[1].String(),
+	}
+
+	if w.logger != nil {
+		attrs := []slog.Attr{
+			slog.Int64("worker", w.id),
+			slog.String("version", w.version),
+		}
+		if w.request != nil {
+			attrs = append(attrs, slog.String("request", w.request.Name))
+		}
+		w.logger.LogAttrs(context.Background(), consoleLevel(msg.Level), msg.Message, attrs...)
+	}
+
+	if w.capture && w.request != nil {
+		w.captured = append(w.captured, msg)
+	}
+
+	return nil, nil
+}
+
+// consoleLevel returns the log level for lines written with the given
+// console method.
+func consoleLevel(level string) slog.Level {
+	switch level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,118 @@
+package reactor
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jcoene/reactor/v8"
+)
+
+// ErrorKind classifies the cause of a RenderError.
+type ErrorKind int
+
+const (
+	// KindCompile means the server script could not be compiled or evaluated
+	// when the worker was created.
+	KindCompile ErrorKind = iota + 1
+
+	// KindException means the server script threw an exception while
+	// rendering, or the promise it returned was rejected. Err is usually a
+	// *v8.JSError.
+	KindException
+
+	// KindComponent means the server script reported an error in the Error
+	// field of its Response. It is only returned as an error by workers
+	// created with ComponentErrors.
+	KindComponent
+
+	// KindProtocol means the Request could not be encoded, the result of the
+	// server script could not be decoded, or the output of a streaming render
+	// could not be written.
+	KindProtocol
+
+	// KindTimeout means the render was aborted because the Request Timeout
+	// elapsed, in which case Err is ErrTimedOut, or because its context was
+	// done, in which case Err is the context's error.
+	KindTimeout
+
+	// KindOutOfMemory means the server script exceeded the MaxHeapSize of
+	// the worker, and Err is ErrOutOfMemory.
+	KindOutOfMemory
+
+	// KindClosed means the worker was closed, and Err is ErrClosed.
+	KindClosed
+)
+
+// String returns a short description of the kind.
+func (k ErrorKind) String() string {
+	switch k {
+	case KindCompile:
+		return "compile"
+	case KindException:
+		return "exception"
+	case KindComponent:
+		return "component"
+	case KindProtocol:
+		return "protocol"
+	case KindTimeout:
+		return "timeout"
+	case KindOutOfMemory:
+		return "out of memory"
+	case KindClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// RenderError is returned when a worker cannot be created, or a Request cannot
+// be rendered. Its message is that of the underlying error, which may be
+// matched with errors.Is, such as errors.Is(err, ErrTimedOut).
+type RenderError struct {
+	// Kind classifies the cause of the error.
+	Kind ErrorKind
+
+	// Version is the ID of the version of the server code which failed.
+	Version string
+
+	// Name is the Name of the Request which failed, if any.
+	Name string
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *RenderError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is a *RenderError of the same Kind, so that
+// errors.Is(err, &RenderError{Kind: KindTimeout}) matches any timeout. The
+// other fields of target are ignored.
+func (e *RenderError) Is(target error) bool {
+	t, ok := target.(*RenderError)
+	return ok && t.Kind == e.Kind
+}
+
+// isKind reports whether err is a RenderError of the given kind.
+func isKind(err error, kind ErrorKind) bool {
+	var re *RenderError
+	return errors.As(err, &re) && re.Kind == kind
+}
+
+// scriptErrorKind returns the kind of an error returned by V8 while running
+// the server script.
+func scriptErrorKind(err error) ErrorKind {
+	var jsErr *v8.JSError
+	switch {
+	case err == v8.ErrOutOfMemory:
+		return KindOutOfMemory
+	case errors.As(err, &jsErr):
+		return KindException
+	}
+	return KindProtocol
+}
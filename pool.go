@@ -1,80 +1,1092 @@
 package reactor
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jcoene/reactor/v8"
+)
+
+var (
+	ErrPoolClosed     = errors.New("pool closed")
+	ErrPoolExhausted  = errors.New("pool exhausted")
+	ErrQueueTimeout   = errors.New("timed out waiting for worker")
+	ErrUnknownVersion = errors.New("unknown version")
 )
 
+// DefaultHistory is the default number of code versions retained by a Pool
+// for rollback. It can be overridden with the History field of PoolOptions.
+var DefaultHistory = 5
+
+// PoolOptions configures the size and queueing behavior of a Pool. The zero
+// value provides an unbounded pool.
+type PoolOptions struct {
+	// MaxWorkers is the maximum number of workers, idle or busy, that the pool
+	// will keep at once. When reached, requests wait in a FIFO queue for a
+	// worker to become available. Zero means no limit.
+	MaxWorkers int
+
+	// MaxQueue is the maximum number of requests that may wait for a worker.
+	// Requests arriving when the queue is full fail with ErrPoolExhausted.
+	// Zero means no limit.
+	MaxQueue int
+
+	// QueueTimeout is the maximum time a request may wait for a worker before
+	// failing with ErrQueueTimeout. Zero means requests wait until their
+	// context is done.
+	QueueTimeout time.Duration
+
+	// MinIdle is the number of idle workers the pool tries to keep ready.
+	// Workers are created in the background, both when the pool is created and
+	// whenever idle workers are taken or discarded, so that requests rarely
+	// pay the cost of creating a worker. It is bounded by MaxWorkers.
+	MinIdle int
+
+	// UpdateWorkers is the number of workers UpdateCode creates with the new
+	// code before switching the pool over to it. Zero means MinIdle, or a
+	// single worker if MinIdle is also zero. It is bounded by MaxWorkers.
+	UpdateWorkers int
+
+	// History is the number of code versions, including the current one,
+	// retained for Versions and Rollback. Zero means DefaultHistory.
+	History int
+
+	// IdleTimeout is the duration after which a worker that has not been used
+	// is closed, though MinIdle workers are always kept. Zero means idle
+	// workers are kept indefinitely.
+	IdleTimeout time.Duration
+
+	// MaxLifetime is the maximum age of a worker, after which it is closed
+	// once idle and replaced as needed. This bounds heap growth and the drift
+	// of global state in the server script. Zero means no limit.
+	MaxLifetime time.Duration
+
+	// MaxRenders is the maximum number of renders performed by a worker,
+	// after which it is closed when returned to the pool. Zero means no limit.
+	MaxRenders int
+
+	// CacheDir is a directory in which to store the V8 code cache data of
+	// each version of the code, and snapshots if enabled, so that new
+	// processes running the same code skip parsing and compiling it. Files
+	// are named after the version and are never removed by the pool. Within a
+	// process, the code is compiled from source only once per version, even
+	// when several workers are created at the same time. Empty means the data
+	// is kept in memory only.
+	CacheDir string
+
+	// Snapshots enables V8 startup snapshots: the code is evaluated once per
+	// version and the resulting heap serialized, and workers are created from
+	// the snapshot without evaluating the code again. Snapshots are stored in
+	// CacheDir, if set, keyed by the code version and V8 version. Code which
+	// cannot be snapshotted, such as code that depends on host functions while
+	// loading, is evaluated in each worker as usual.
+	Snapshots bool
+
+	// Worker configures each worker created by the pool. Its Snapshot and
+	// CachedData are ignored, as they belong to a single version of the code;
+	// the pool derives them for each version it loads instead.
+	Worker WorkerOptions
+}
+
+// UpdateOptions configures the validation performed by UpdateCodeWithOptions
+// before new code is accepted.
+type UpdateOptions struct {
+	// SmokeTests are requests rendered with the new code before it is
+	// accepted. Each must render without error, including any error reported
+	// by the server script in the Response.
+	SmokeTests []*Request
+
+	// Label is a free-form description of the new code, such as the deploy or
+	// user responsible for it, which is recorded in the version history.
+	Label string
+
+	// SourceMap maps the new code back to its original source files, as
+	// WorkerOptions.SourceMap does for the initial code.
+	SourceMap *SourceMap
+}
+
+// Version describes a version of server code loaded into a Pool.
+type Version struct {
+	// ID is the checksum of the code, which identifies the version.
+	ID string
+
+	// LoadedAt is the time the pool most recently switched to the version.
+	LoadedAt time.Time
+
+	// Label is the label supplied when the version was loaded, if any.
+	Label string
+
+	code      string
+	sourceMap *SourceMap
+}
+
 // Pool provides a dynamically growing pool of workers capable of rendering.
 type Pool struct {
-	code    string
-	version string
+	code      string
+	sourceMap *SourceMap
+	version   string
+	opts      PoolOptions
+
+	history []*Version
+
+	// codeCache and snapshots hold the code cache data and startup snapshot
+	// of each retained version of the code.
+	codeCache *blobCache
+	snapshots *blobCache
 
 	workers []*Worker
+	size    int
+	active  int
+	waiters []chan *Worker
+	filling bool
+	closed  bool
+	drained chan struct{}
+	stop    chan struct{}
 	mu      sync.Mutex
+
+	// all tracks every worker created by the pool until it is retired. It is
+	// guarded by allMu, which may be acquired while holding mu.
+	all   map[*Worker]struct{}
+	allMu sync.Mutex
+
+	// creating counts the goroutines creating workers outside the pool lock,
+	// so that Close can wait for those workers to be retired.
+	creating sync.WaitGroup
+
+	updateMu sync.Mutex
 }
 
-// NewPool creates a new Pool of workers with the given server code. It
-// creates a single Worker with the given code. Additional workers will
-// be created on-demand as needed.
+// PoolHeapStatistics summarizes the heap usage of the workers in a Pool, as of
+// the most recent render performed by each worker.
+type PoolHeapStatistics struct {
+	// Workers is the number of workers included.
+	Workers int
+
+	// Total is the sum of the heap statistics of all workers.
+	Total v8.HeapStatistics
+
+	// MaxUsedHeapSize is the largest UsedHeapSize of any single worker.
+	MaxUsedHeapSize uint64
+}
+
+// NewPool creates a new Pool of workers with the given server code. Workers
+// will be created on-demand as needed, without limit.
 func NewPool(code string) *Pool {
-	return &Pool{
-		code:    code,
-		version: checksum(code),
+	return NewPoolWithOptions(code, PoolOptions{})
+}
+
+// NewPoolWithOptions creates a new Pool of workers with the given server code
+// and options. Workers will be created on-demand as needed, up to the limit
+// given in the options, and MinIdle workers begin warming up immediately.
+func NewPoolWithOptions(code string, opts PoolOptions) *Pool {
+	p := &Pool{
+		code:      code,
+		sourceMap: opts.Worker.SourceMap,
+		version:   checksum(code),
+		opts:      opts,
+		codeCache: newBlobCache(opts.CacheDir, ".codecache"),
+		snapshots: newBlobCache(opts.CacheDir, ".v8-"+v8.Version()+".snapshot"),
+		stop:      make(chan struct{}),
+		all:       make(map[*Worker]struct{}),
 	}
+
+	p.mu.Lock()
+	p.recordLocked(code, opts.Worker.SourceMap, "")
+	p.replenishLocked()
+	p.mu.Unlock()
+
+	if interval := reapInterval(opts); interval > 0 {
+		go p.janitor(interval)
+	}
+
+	return p
 }
 
-// UpdateCode updates the server code for the pool, causing any existing
-// workers running an older version of the code to be closed in the future.
-// Any requests that are currently in-flight will be allowed to finish.
+// UpdateCode updates the server code for the pool. Replacement workers are
+// created with the new code while the existing workers continue to serve
+// requests, and the pool only switches over once UpdateWorkers of them are
+// ready. Idle workers running an older version of the code are then closed,
+// and busy ones are closed when they are returned, so any requests that are
+// currently in-flight will be allowed to finish.
+//
+// Replacement workers are counted towards MaxWorkers, so if the pool is too
+// busy to make room for all of them, it switches over with fewer and creates
+// the rest on demand.
+//
+// UpdateCode blocks until the switch is complete. If the new code cannot be
+// evaluated, the pool switches over anyway, and subsequent requests will
+// fail with the resulting error. The new code has no source map; use
+// UpdateCodeWithOptions to supply one.
 func (p *Pool) UpdateCode(code string) {
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+
+	if !p.beginCreate() {
+		return
+	}
+	defer p.creating.Done()
+
+	fresh, _ := p.build(code, nil)
+	p.swap(code, nil, "", fresh)
+}
+
+// Close stops the pool from accepting new requests, which fail with
+// ErrPoolClosed, and waits for requests in-flight to return their workers
+// and for workers being created to be ready, before closing every worker in
+// the pool. If ctx is done first, Close closes the idle workers and returns
+// ctx.Err(); the remaining workers are closed as soon as they are returned or
+// created. It is safe to call Close more than once.
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		p.drained = make(chan struct{})
+		close(p.stop)
+		for _, ch := range p.waiters {
+			close(ch)
+		}
+		p.waiters = nil
+		p.drainLocked()
+	}
+	drained := p.drained
+	p.mu.Unlock()
+
+	// No creation can begin once the pool is closed, so it is safe to wait
+	// for those in progress.
+	created := make(chan struct{})
+	go func() {
+		p.creating.Wait()
+		close(created)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		select {
+		case <-created:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.mu.Lock()
+	idle := p.workers
+	p.workers = nil
+	p.size -= len(idle)
+	p.mu.Unlock()
+
+	for _, w := range idle {
+		p.retire(w)
+	}
+
+	return err
+}
+
+// UpdateCodeWithOptions updates the server code for the pool like UpdateCode,
+// but only after validating it. The code is first evaluated in a scratch
+// worker, which must define the global render function and successfully
+// render each of the smoke tests in opts. If validation fails or replacement
+// workers cannot be created, an error is returned and the pool continues to
+// serve requests with its existing code.
+func (p *Pool) UpdateCodeWithOptions(code string, opts UpdateOptions) error {
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+
+	if !p.beginCreate() {
+		return ErrPoolClosed
+	}
+	defer p.creating.Done()
+
+	if err := p.validate(code, opts); err != nil {
+		return err
+	}
+
+	fresh, err := p.build(code, opts.SourceMap)
+	if err != nil {
+		return err
+	}
+
+	return p.swap(code, opts.SourceMap, opts.Label, fresh)
+}
+
+// Versions returns the code versions retained by the pool, most recently
+// loaded first. The first Version is the one currently in use.
+func (p *Pool) Versions() []Version {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	versions := make([]Version, len(p.history))
+	for i, v := range p.history {
+		versions[i] = *v
+		versions[i].code = ""
+		versions[i].sourceMap = nil
+	}
+	return versions
+}
+
+// Rollback switches the pool back to a previously loaded version of the code,
+// identified by its ID, in the same manner as UpdateCode. It returns
+// ErrUnknownVersion if the version is no longer retained. If replacement
+// workers cannot be created, an error is returned and the pool continues to
+// serve requests with its existing code.
+func (p *Pool) Rollback(id string) error {
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+
+	var version *Version
 	p.mu.Lock()
+	for _, v := range p.history {
+		if v.ID == id {
+			version = v
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if version == nil {
+		return ErrUnknownVersion
+	}
+
+	if !p.beginCreate() {
+		return ErrPoolClosed
+	}
+	defer p.creating.Done()
+
+	fresh, err := p.build(version.code, version.sourceMap)
+	if err != nil {
+		return err
+	}
+
+	return p.swap(version.code, version.sourceMap, version.Label, fresh)
+}
+
+// validate evaluates the given code in a scratch worker and renders the smoke
+// tests in opts, returning the first failure encountered.
+func (p *Pool) validate(code string, opts UpdateOptions) error {
+	w, err := loadWorker(code, p.workerOptions(opts.SourceMap), p.codeCache)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	ok, err := w.hasEntryFunction()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("server script does not define a global %s function", entryFunction)
+	}
+
+	for _, req := range opts.SmokeTests {
+		resp, err := w.Render(req)
+		if err != nil {
+			return fmt.Errorf("smoke test %q failed: %w", req.Name, err)
+		}
+		if resp.Error != "" {
+			return fmt.Errorf("smoke test %q failed: %s", req.Name, resp.Error)
+		}
+	}
+
+	return nil
+}
+
+// build creates the workers used to switch the pool over to the given code
+// and source map. They are not counted towards MaxWorkers until swap adds
+// them, so that the existing workers keep serving requests in the meantime.
+// If any of them cannot be created, those already created are closed.
+func (p *Pool) build(code string, sm *SourceMap) ([]*Worker, error) {
+	n := p.replacements()
+
+	workers := make([]*Worker, 0, n)
+	for i := 0; i < n; i++ {
+		w, err := p.newWorker(code, sm)
+		if err != nil {
+			for _, w := range workers {
+				p.retire(w)
+			}
+			return nil, err
+		}
+		workers = append(workers, w)
+	}
+
+	return workers, nil
+}
+
+// replacements returns how many workers build should create: UpdateWorkers,
+// or fewer if too many workers are busy for them all to take the places of
+// the idle workers within MaxWorkers. The pool creates the remaining workers
+// on demand once it has switched over.
+func (p *Pool) replacements() int {
+	n := p.opts.UpdateWorkers
+	if n <= 0 {
+		n = p.opts.MinIdle
+	}
+	if n <= 0 {
+		n = 1
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if max := p.opts.MaxWorkers; max > 0 {
+		if free := max - (p.size - len(p.workers)); n > free {
+			n = free
+		}
+		if n < 0 {
+			n = 0
+		}
+	}
+	return n
+}
+
+// swap switches the pool over to the given code and source map, adding the
+// fresh workers created with it and closing idle workers running any older
+// version. Fresh workers which no longer fit within MaxWorkers, because more
+// workers became busy while they were created, are closed. If the pool has
+// been closed, the fresh workers are closed and ErrPoolClosed is returned
+// instead.
+func (p *Pool) swap(code string, sm *SourceMap, label string, fresh []*Worker) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		for _, w := range fresh {
+			p.retire(w)
+		}
+		return ErrPoolClosed
+	}
+
 	p.code = code
+	p.sourceMap = sm
 	p.version = checksum(code)
+	p.recordLocked(code, sm, label)
+
+	stale := p.workers
+	p.workers = nil
+	p.size -= len(stale)
+	if max := p.opts.MaxWorkers; max > 0 && p.size+len(fresh) > max {
+		free := max - p.size
+		if free < 0 {
+			free = 0
+		}
+		stale = append(stale, fresh[free:]...)
+		fresh = fresh[:free]
+	}
+	p.size += len(fresh)
+	for _, w := range fresh {
+		p.putLocked(w)
+	}
+	p.grantLocked()
+	p.replenishLocked()
 	p.mu.Unlock()
+
+	for _, w := range stale {
+		p.retire(w)
+	}
+
+	return nil
+}
+
+// recordLocked adds the given code to the front of the version history,
+// moving it there if it was already present, and trims the history to its
+// maximum length. The caller must hold the pool lock.
+func (p *Pool) recordLocked(code string, sm *SourceMap, label string) {
+	v := &Version{
+		ID:        checksum(code),
+		LoadedAt:  time.Now(),
+		Label:     label,
+		code:      code,
+		sourceMap: sm,
+	}
+
+	history := []*Version{v}
+	for _, old := range p.history {
+		if old.ID != v.ID {
+			history = append(history, old)
+		}
+	}
+
+	max := p.opts.History
+	if max <= 0 {
+		max = DefaultHistory
+	}
+	if len(history) > max {
+		history = history[:max]
+	}
+
+	p.history = history
+	p.codeCache.retain(history)
+	p.snapshots.retain(history)
 }
 
 // Render renders a React component with a worker from the pool. If a worker
 // with the current code version is not available, a new worker will be created.
 func (p *Pool) Render(req *Request) (*Response, error) {
-	w, err := p.Get()
+	return p.RenderContext(context.Background(), req)
+}
+
+// RenderContext renders a React component with a worker from the pool,
+// aborting the render and returning ctx.Err() if ctx is cancelled or its
+// deadline passes before the render completes, including while waiting for
+// a worker. Errors from creating a worker or rendering are returned as a
+// *RenderError, while errors from the pool itself, such as ErrPoolExhausted,
+// are returned as they are.
+func (p *Pool) RenderContext(ctx context.Context, req *Request) (*Response, error) {
+	w, err := p.acquire(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := w.Render(req)
+	resp, err := w.RenderContext(ctx, req)
+	p.finish(w, err)
+	if err != nil && !isKind(err, KindComponent) {
+		return nil, err
+	}
+
+	return resp, err
+}
+
+// RenderInto renders a Request with a worker from the pool like
+// RenderContext, but decodes the result of the server script into out as
+// Worker.RenderInto does.
+func (p *Pool) RenderInto(ctx context.Context, req *Request, out interface{}) error {
+	w, err := p.acquire(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	err = w.RenderInto(ctx, req, out)
+	p.finish(w, err)
+
+	return err
+}
+
+// RenderStream renders a Request with a worker from the pool as a stream
+// written to out, as Worker.RenderStream does.
+func (p *Pool) RenderStream(ctx context.Context, req *Request, out io.Writer) error {
+	w, err := p.acquire(ctx, req)
 	if err != nil {
-		w.Close()
+		return err
+	}
+
+	err = w.RenderStream(ctx, req, out)
+	p.finish(w, err)
+
+	return err
+}
+
+// acquire gets a worker to render the given request with, unless ctx is
+// already done. If a worker cannot be created, the RenderError is returned
+// with the name of the request.
+func (p *Pool) acquire(ctx context.Context, req *Request) (*Worker, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	p.Put(w)
+	w, err := p.GetContext(ctx)
+	if err != nil {
+		var re *RenderError
+		if errors.As(err, &re) {
+			named := *re
+			named.Name = req.Name
+			return nil, &named
+		}
+		return nil, err
+	}
 
-	return resp, nil
+	return w, nil
 }
 
 // Get returns the next worker from the pool, creating a new worker if needed.
 // Workers with previous code versions will be discarded, resulting in a new
-// worker being created.
+// worker being created. If the pool is at capacity, Get waits for a worker to
+// be returned.
 func (p *Pool) Get() (*Worker, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext is like Get, but stops waiting for a worker and returns
+// ctx.Err() if ctx is done first.
+func (p *Pool) GetContext(ctx context.Context) (*Worker, error) {
 	p.mu.Lock()
-	defer p.mu.Unlock()
 
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+
+	// Take the most recently used worker, leaving the others to go unused
+	// for long enough to be reaped once demand falls.
 	for len(p.workers) > 0 {
-		w := p.workers[0]
-		p.workers = p.workers[1:]
-		if w.closed || w.version != p.version {
-			w.Close()
+		w := p.workers[len(p.workers)-1]
+		p.workers = p.workers[:len(p.workers)-1]
+		if w.closed || w.version != p.version || p.expiredLocked(w) {
+			p.retire(w)
+			p.size--
 			continue
 		}
+		p.active++
+		p.replenishLocked()
+		p.mu.Unlock()
 		return w, nil
 	}
 
-	return NewWorker(p.code)
+	if p.opts.MaxWorkers <= 0 || p.size < p.opts.MaxWorkers {
+		p.size++
+		p.mu.Unlock()
+		return p.create()
+	}
+
+	if p.opts.MaxQueue > 0 && len(p.waiters) >= p.opts.MaxQueue {
+		p.mu.Unlock()
+		return nil, ErrPoolExhausted
+	}
+
+	ch := make(chan *Worker, 1)
+	p.waiters = append(p.waiters, ch)
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if p.opts.QueueTimeout > 0 {
+		timer := time.NewTimer(p.opts.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case w, ok := <-ch:
+		if !ok {
+			return nil, ErrPoolClosed
+		}
+		return p.accept(w)
+	case <-ctx.Done():
+		p.cancelWait(ch)
+		return nil, ctx.Err()
+	case <-timeout:
+		p.cancelWait(ch)
+		return nil, ErrQueueTimeout
+	}
 }
 
-// Put returns a worker to the pool to be re-used in the future
+// Put returns a worker obtained from Get to the pool to be re-used in the
+// future. If a request is waiting for a worker, it is handed over directly.
 func (p *Pool) Put(w *Worker) {
 	p.mu.Lock()
+	p.active--
+	p.putLocked(w)
+	p.drainLocked()
+	p.mu.Unlock()
+}
+
+// putLocked adds a worker to the pool, closing it if it is no longer usable
+// or the pool has been closed. The caller must hold the pool lock.
+func (p *Pool) putLocked(w *Worker) {
+	if p.closed {
+		p.retire(w)
+		p.size--
+		return
+	}
+
+	if w.closed || w.version != p.version || p.expiredLocked(w) {
+		p.retire(w)
+		p.releaseLocked()
+		return
+	}
+
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		ch <- w
+		return
+	}
+
+	w.idle = time.Now()
 	p.workers = append(p.workers, w)
+}
+
+// expiredLocked reports whether a worker has exceeded MaxLifetime or
+// MaxRenders. The caller must hold the pool lock.
+func (p *Pool) expiredLocked(w *Worker) bool {
+	if p.opts.MaxLifetime > 0 && time.Since(w.created) >= p.opts.MaxLifetime {
+		return true
+	}
+	return p.opts.MaxRenders > 0 && atomic.LoadInt64(&w.renders) >= int64(p.opts.MaxRenders)
+}
+
+// reapInterval returns how often the janitor should check for idle workers to
+// reap given the pool options, or zero if it isn't needed.
+func reapInterval(opts PoolOptions) time.Duration {
+	var interval time.Duration
+	for _, d := range []time.Duration{opts.IdleTimeout, opts.MaxLifetime} {
+		if d > 0 && (interval == 0 || d < interval) {
+			interval = d
+		}
+	}
+
+	interval /= 2
+	if interval > 0 && interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+// janitor periodically reaps idle workers until the pool is closed.
+func (p *Pool) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.reap()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// reap closes idle workers which have exceeded MaxLifetime, and those beyond
+// MinIdle which have been idle for longer than IdleTimeout.
+func (p *Pool) reap() {
+	p.mu.Lock()
+
+	var reaped, kept []*Worker
+	for i, w := range p.workers {
+		// Workers are ordered from least to most recently used, so the last
+		// MinIdle are kept regardless of IdleTimeout.
+		spare := len(p.workers)-i > p.opts.MinIdle
+		idle := p.opts.IdleTimeout > 0 && time.Since(w.idle) >= p.opts.IdleTimeout
+		if p.expiredLocked(w) || (spare && idle) {
+			reaped = append(reaped, w)
+		} else {
+			kept = append(kept, w)
+		}
+	}
+
+	p.workers = kept
+	p.size -= len(reaped)
+	if len(reaped) > 0 {
+		p.grantLocked()
+		p.replenishLocked()
+	}
+	p.mu.Unlock()
+
+	for _, w := range reaped {
+		p.retire(w)
+	}
+}
+
+// HeapStatistics returns the heap usage of all workers in the pool, whether
+// idle or busy, as of the most recent render performed by each.
+func (p *Pool) HeapStatistics() PoolHeapStatistics {
+	p.allMu.Lock()
+	workers := make([]*Worker, 0, len(p.all))
+	for w := range p.all {
+		workers = append(workers, w)
+	}
+	p.allMu.Unlock()
+
+	var stats PoolHeapStatistics
+	for _, w := range workers {
+		hs := w.lastHeapStatistics()
+		stats.Workers++
+		stats.Total.TotalHeapSize += hs.TotalHeapSize
+		stats.Total.TotalHeapSizeExecutable += hs.TotalHeapSizeExecutable
+		stats.Total.TotalPhysicalSize += hs.TotalPhysicalSize
+		stats.Total.TotalAvailableSize += hs.TotalAvailableSize
+		stats.Total.UsedHeapSize += hs.UsedHeapSize
+		stats.Total.HeapSizeLimit += hs.HeapSizeLimit
+		stats.Total.MallocedMemory += hs.MallocedMemory
+		stats.Total.PeakMallocedMemory += hs.PeakMallocedMemory
+		stats.Total.ExternalMemory += hs.ExternalMemory
+		stats.Total.NumberOfNativeContexts += hs.NumberOfNativeContexts
+		if hs.UsedHeapSize > stats.MaxUsedHeapSize {
+			stats.MaxUsedHeapSize = hs.UsedHeapSize
+		}
+	}
+
+	return stats
+}
+
+// newWorker creates a worker with the given code, source map and pool
+// options, tracking it until it is retired. Workers for the same code share
+// its code cache data, so that it is only compiled from source once, and its
+// snapshot if enabled.
+func (p *Pool) newWorker(code string, sm *SourceMap) (*Worker, error) {
+	opts := p.workerOptions(sm)
+	if p.opts.Snapshots {
+		opts.Snapshot = p.snapshot(code)
+	}
+
+	w, err := loadWorker(code, opts, p.codeCache)
+	if err != nil {
+		return nil, err
+	}
+
+	p.allMu.Lock()
+	p.all[w] = struct{}{}
+	p.allMu.Unlock()
+
+	return w, nil
+}
+
+// workerOptions returns the options for a worker running code with the given
+// source map. The configured Snapshot and CachedData are dropped, as workers
+// for any other version of the code would otherwise use them too.
+func (p *Pool) workerOptions(sm *SourceMap) WorkerOptions {
+	opts := p.opts.Worker
+	opts.SourceMap = sm
+	opts.Snapshot = nil
+	opts.CachedData = nil
+	return opts
+}
+
+// snapshot returns the startup snapshot for the given code, creating it if
+// necessary, or nil if the code cannot be snapshotted.
+func (p *Pool) snapshot(code string) *v8.Snapshot {
+	version := checksum(code)
+
+	defer p.snapshots.lock(version)()
+
+	data, ok := p.snapshots.get(version)
+	if !ok {
+		// A failure is remembered as an empty snapshot, so that it is not
+		// attempted again for every worker.
+		if snapshot, err := v8.CreateSnapshot(code, serverScriptName); err == nil {
+			data = snapshot.Bytes()
+		}
+		p.snapshots.put(version, data)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	return v8.NewSnapshot(data)
+}
+
+// retire closes a worker created by newWorker and stops tracking it.
+func (p *Pool) retire(w *Worker) {
+	w.Close()
+
+	p.allMu.Lock()
+	delete(p.all, w)
+	p.allMu.Unlock()
+}
+
+// finish returns a worker obtained from Get after a render with the given
+// result. Workers are discarded if the render failed, as it may have left
+// them in a bad state, unless the server script only reported a component
+// error.
+func (p *Pool) finish(w *Worker, err error) {
+	if err != nil && !isKind(err, KindComponent) {
+		p.discard(w)
+		return
+	}
+	p.Put(w)
+}
+
+// discard closes a worker obtained from Get, freeing its place in the pool.
+func (p *Pool) discard(w *Worker) {
+	p.retire(w)
+
+	p.mu.Lock()
+	p.active--
+	p.releaseLocked()
+	p.drainLocked()
+	p.mu.Unlock()
+}
+
+// drainLocked signals Close once the pool has been closed and every worker
+// obtained from Get has been returned. The caller must hold the pool lock.
+func (p *Pool) drainLocked() {
+	if !p.closed || p.active > 0 {
+		return
+	}
+	select {
+	case <-p.drained:
+	default:
+		close(p.drained)
+	}
+}
+
+// create creates a new worker with the current code for a caller of Get,
+// using a place in the pool that has already been reserved by the caller.
+// The place is released if the worker cannot be created.
+func (p *Pool) create() (*Worker, error) {
+	p.mu.Lock()
+	if !p.beginCreateLocked() {
+		p.releaseLocked()
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	code, sm := p.code, p.sourceMap
 	p.mu.Unlock()
+	defer p.creating.Done()
+
+	w, err := p.newWorker(code, sm)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		p.releaseLocked()
+		return nil, err
+	}
+	if p.closed {
+		p.retire(w)
+		p.size--
+		return nil, ErrPoolClosed
+	}
+
+	p.active++
+	return w, nil
+}
+
+// accept takes the worker handed to a waiting request. A nil worker means
+// the waiter was handed a free place in the pool, and should create a new
+// worker to fill it.
+func (p *Pool) accept(w *Worker) (*Worker, error) {
+	if w == nil {
+		return p.create()
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.retire(w)
+		p.size--
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	stale := w.closed || w.version != p.version
+	if !stale {
+		p.active++
+	}
+	p.mu.Unlock()
+
+	if stale {
+		p.retire(w)
+		return p.create()
+	}
+
+	return w, nil
+}
+
+// cancelWait removes a waiting request from the queue. If a worker or free
+// place was handed over in the meantime, it is passed along to the next
+// waiter or returned to the pool.
+func (p *Pool) cancelWait(ch chan *Worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, wch := range p.waiters {
+		if wch == ch {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return
+		}
+	}
+
+	w, ok := <-ch
+	if !ok {
+		return
+	}
+	if w != nil {
+		p.putLocked(w)
+	} else {
+		p.releaseLocked()
+	}
+}
+
+// releaseLocked frees a place in the pool, handing it to the next waiting
+// request if there is one. The caller must hold the pool lock.
+func (p *Pool) releaseLocked() {
+	p.size--
+	p.grantLocked()
+	p.replenishLocked()
+}
+
+// grantLocked hands free places in the pool to waiting requests, which will
+// each create a new worker. The caller must hold the pool lock.
+func (p *Pool) grantLocked() {
+	for len(p.waiters) > 0 && (p.opts.MaxWorkers <= 0 || p.size < p.opts.MaxWorkers) {
+		p.size++
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		ch <- nil
+	}
+}
+
+// replenishLocked starts creating workers in the background if fewer than
+// MinIdle are idle and the pool has room for more. The caller must hold the
+// pool lock.
+func (p *Pool) replenishLocked() {
+	if p.filling || !p.needsWorkerLocked() {
+		return
+	}
+	p.filling = true
+	go p.replenish()
+}
+
+// beginCreate records that workers are about to be created outside the pool
+// lock, so that Close waits for them. It reports false if the pool is closed,
+// in which case none may be created. Otherwise, p.creating.Done must be
+// called once the workers are in the pool or retired.
+func (p *Pool) beginCreate() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.beginCreateLocked()
+}
+
+// beginCreateLocked is like beginCreate. The caller must hold the pool lock.
+func (p *Pool) beginCreateLocked() bool {
+	if p.closed {
+		return false
+	}
+	p.creating.Add(1)
+	return true
+}
+
+// needsWorkerLocked reports whether the pool should create a worker to reach
+// MinIdle. The caller must hold the pool lock.
+func (p *Pool) needsWorkerLocked() bool {
+	if p.closed || len(p.workers) >= p.opts.MinIdle {
+		return false
+	}
+	return p.opts.MaxWorkers <= 0 || p.size < p.opts.MaxWorkers
+}
+
+// replenish creates workers one at a time until the pool no longer needs
+// them. It stops early if a worker cannot be created, leaving requests to
+// create workers on-demand and surface the error.
+func (p *Pool) replenish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.needsWorkerLocked() && p.beginCreateLocked() {
+		p.size++
+		code, sm := p.code, p.sourceMap
+		p.mu.Unlock()
+
+		w, err := p.newWorker(code, sm)
+
+		p.mu.Lock()
+		if err != nil {
+			p.size--
+			p.creating.Done()
+			break
+		}
+		p.putLocked(w)
+		p.creating.Done()
+	}
+
+	p.filling = false
 }
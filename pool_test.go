@@ -1,9 +1,17 @@
 package reactor
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/jcoene/reactor/v8"
 )
 
 func TestPoolRenderEmptyCode(t *testing.T) {
@@ -28,6 +36,337 @@ func TestPoolRenderInvalidCode(t *testing.T) {
 	}
 }
 
+func TestPoolRenderContextDeadline(t *testing.T) {
+	p := NewPool(`function render() { while (true) {} }`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	resp, err := p.RenderContext(ctx, &Request{})
+	assertNil(t, resp)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestPoolMaxWorkers(t *testing.T) {
+	p := NewPoolWithOptions(`function render() { return '{"html": "<div>OK</div>"}'; }`, PoolOptions{
+		MaxWorkers:   1,
+		MaxQueue:     1,
+		QueueTimeout: 50 * time.Millisecond,
+	})
+
+	w, err := p.Get()
+	assertNil(t, err)
+	assertNotNil(t, w)
+
+	// the only worker is busy, so the next request waits and times out
+	_, err = p.Get()
+	if err != ErrQueueTimeout {
+		t.Fatalf("expected ErrQueueTimeout, got %v", err)
+	}
+
+	// fill the queue, then overflow it
+	ch := make(chan *Worker)
+	go func() {
+		w2, err := p.Get()
+		assertNil(t, err)
+		ch <- w2
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = p.Get()
+	if err != ErrPoolExhausted {
+		t.Fatalf("expected ErrPoolExhausted, got %v", err)
+	}
+
+	// returning the worker hands it to the queued request
+	p.Put(w)
+	if w2 := <-ch; w2 != w {
+		t.Errorf("expected queued request to receive the returned worker")
+	}
+}
+
+func TestPoolMinIdle(t *testing.T) {
+	p := NewPoolWithOptions(`function render() { return '{"html": "<div>OK</div>"}'; }`, PoolOptions{
+		MinIdle: 2,
+	})
+
+	waitForIdle(t, p, 2)
+
+	// taking a worker causes a replacement to be created in the background
+	w, err := p.Get()
+	assertNil(t, err)
+	waitForIdle(t, p, 2)
+	p.Put(w)
+}
+
+func TestPoolUpdateCodeWarmsWorkers(t *testing.T) {
+	code1 := `function render() { return '{"html": "<div>1</div>"}'; }`
+	code2 := `function render() { return '{"html": "<div>2</div>"}'; }`
+
+	p := NewPoolWithOptions(code1, PoolOptions{UpdateWorkers: 3})
+	w, err := p.Get()
+	assertNil(t, err)
+
+	p.UpdateCode(code2)
+
+	// replacement workers are ready as soon as UpdateCode returns
+	p.mu.Lock()
+	idle := len(p.workers)
+	for _, iw := range p.workers {
+		if iw.version != checksum(code2) {
+			t.Errorf("expected idle worker to run the new code")
+		}
+	}
+	p.mu.Unlock()
+	if idle != 3 {
+		t.Errorf("expected 3 idle workers, got %d", idle)
+	}
+
+	// the worker that was busy during the update is closed when returned
+	p.Put(w)
+	if !w.closed {
+		t.Errorf("expected stale worker to be closed")
+	}
+}
+
+func TestPoolUpdateCodeWithOptions(t *testing.T) {
+	code1 := `function render() { return '{"html": "<div>1</div>"}'; }`
+	code2 := `function render(json) {
+		if (JSON.parse(json).name === "Broken") { return '{"error": "broken"}'; }
+		return '{"html": "<div>2</div>"}';
+	}`
+
+	p := NewPool(code1)
+
+	invalid := []string{
+		"throw 'hi';",
+		"function draw() {}",
+	}
+	for _, code := range invalid {
+		err := p.UpdateCodeWithOptions(code, UpdateOptions{})
+		assertNotNil(t, err)
+	}
+
+	err := p.UpdateCodeWithOptions(code2, UpdateOptions{
+		SmokeTests: []*Request{{Name: "Widget"}, {Name: "Broken"}},
+	})
+	assertNotNil(t, err)
+	if err != nil {
+		assertContains(t, err.Error(), "broken")
+	}
+
+	// the original code is still being served
+	resp, err := p.Render(&Request{})
+	assertNil(t, err)
+	if resp != nil {
+		assertContains(t, resp.HTML, "1")
+	}
+
+	err = p.UpdateCodeWithOptions(code2, UpdateOptions{
+		SmokeTests: []*Request{{Name: "Widget"}},
+	})
+	assertNil(t, err)
+
+	resp, err = p.Render(&Request{})
+	assertNil(t, err)
+	if resp != nil {
+		assertContains(t, resp.HTML, "2")
+	}
+}
+
+func TestPoolVersionsRollback(t *testing.T) {
+	code1 := `function render() { return '{"html": "<div>1</div>"}'; }`
+	code2 := `function render() { return '{"html": "<div>2</div>"}'; }`
+	code3 := `function render() { return '{"html": "<div>3</div>"}'; }`
+
+	p := NewPoolWithOptions(code1, PoolOptions{History: 2})
+	assertNil(t, p.UpdateCodeWithOptions(code2, UpdateOptions{Label: "deploy 2"}))
+	assertNil(t, p.UpdateCodeWithOptions(code3, UpdateOptions{Label: "deploy 3"}))
+
+	versions := p.Versions()
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(versions))
+	}
+	if versions[0].ID != checksum(code3) || versions[0].Label != "deploy 3" {
+		t.Errorf("unexpected current version: %+v", versions[0])
+	}
+	if versions[1].ID != checksum(code2) || versions[1].Label != "deploy 2" {
+		t.Errorf("unexpected previous version: %+v", versions[1])
+	}
+
+	if err := p.Rollback(checksum(code1)); err != ErrUnknownVersion {
+		t.Errorf("expected ErrUnknownVersion, got %v", err)
+	}
+
+	assertNil(t, p.Rollback(versions[1].ID))
+	resp, err := p.Render(&Request{})
+	assertNil(t, err)
+	if resp != nil {
+		assertContains(t, resp.HTML, "2")
+	}
+	if v := p.Versions()[0]; v.ID != checksum(code2) {
+		t.Errorf("expected rolled back version to be current, got %+v", v)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	p := NewPoolWithOptions(`function render() { return '{"html": "<div>OK</div>"}'; }`, PoolOptions{
+		MinIdle: 1,
+	})
+	waitForIdle(t, p, 1)
+
+	w, err := p.Get()
+	assertNil(t, err)
+
+	// Close waits for the busy worker to be returned
+	done := make(chan error)
+	go func() {
+		done <- p.Close(context.Background())
+	}()
+
+	resp, err := w.Render(&Request{})
+	assertNil(t, err)
+	assertNotNil(t, resp)
+
+	for closed := false; !closed; {
+		p.mu.Lock()
+		closed = p.closed
+		p.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	_, err = p.Render(&Request{})
+	if err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed, got %v", err)
+	}
+
+	p.Put(w)
+	assertNil(t, <-done)
+	if !w.closed {
+		t.Errorf("expected returned worker to be closed")
+	}
+	p.mu.Lock()
+	if len(p.workers) != 0 || p.size != 0 {
+		t.Errorf("expected no workers after close, got %d idle of %d", len(p.workers), p.size)
+	}
+	p.mu.Unlock()
+
+	// workers still being created by the replenish started by Get are
+	// closed before Close returns
+	p.allMu.Lock()
+	if n := len(p.all); n != 0 {
+		t.Errorf("expected every worker to be closed, got %d open", n)
+	}
+	p.allMu.Unlock()
+}
+
+func TestPoolCloseDeadline(t *testing.T) {
+	p := NewPool(`function render() { return '{"html": "<div>OK</div>"}'; }`)
+
+	w, err := p.Get()
+	assertNil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	p.Put(w)
+	if !w.closed {
+		t.Errorf("expected worker returned after close to be closed")
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	p := NewPoolWithOptions(`function render() { return '{"html": "<div>OK</div>"}'; }`, PoolOptions{
+		MinIdle:     1,
+		IdleTimeout: 20 * time.Millisecond,
+	})
+	defer p.Close(context.Background())
+
+	w1, err := p.Get()
+	assertNil(t, err)
+	w2, err := p.Get()
+	assertNil(t, err)
+	p.Put(w1)
+	p.Put(w2)
+
+	// all but MinIdle workers are reaped once idle for IdleTimeout
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		idle := len(p.workers)
+		p.mu.Unlock()
+		if idle == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for idle workers to be reaped")
+}
+
+func TestPoolMaxRenders(t *testing.T) {
+	p := NewPoolWithOptions(`function render() { return '{"html": "<div>OK</div>"}'; }`, PoolOptions{
+		MaxRenders: 2,
+	})
+
+	w, err := p.Get()
+	assertNil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := w.Render(&Request{})
+		assertNil(t, err)
+	}
+
+	p.Put(w)
+	if !w.closed {
+		t.Errorf("expected worker to be retired after MaxRenders")
+	}
+}
+
+func TestPoolHeapStatistics(t *testing.T) {
+	p := NewPool(`function render() { return '{"html": "<div>OK</div>"}'; }`)
+
+	w, err := p.Get()
+	assertNil(t, err)
+	w2, err := p.Get()
+	assertNil(t, err)
+	p.Put(w2)
+
+	// both idle and busy workers are included
+	stats := p.HeapStatistics()
+	if stats.Workers != 2 {
+		t.Errorf("expected 2 workers, got %d", stats.Workers)
+	}
+	if stats.Total.UsedHeapSize == 0 || stats.MaxUsedHeapSize == 0 || stats.MaxUsedHeapSize > stats.Total.UsedHeapSize {
+		t.Errorf("unexpected heap statistics: %+v", stats)
+	}
+	if stats.Total.NumberOfNativeContexts != 2 {
+		t.Errorf("expected 2 native contexts, got %d", stats.Total.NumberOfNativeContexts)
+	}
+
+	p.Put(w)
+	assertNil(t, p.Close(context.Background()))
+	if stats := p.HeapStatistics(); stats.Workers != 0 {
+		t.Errorf("expected no workers after close, got %d", stats.Workers)
+	}
+}
+
+func waitForIdle(t *testing.T, p *Pool, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		idle := len(p.workers)
+		p.mu.Unlock()
+		if idle >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d idle workers", n)
+}
+
 func TestPoolUpdateCode(t *testing.T) {
 	code1 := `function render() { return '{"html": "<div>1</div>"}'; }`
 	code2 := `function render() { return '{"html": "<div>2</div>"}'; }`
@@ -53,6 +392,28 @@ func TestPoolUpdateCode(t *testing.T) {
 	}
 }
 
+func TestPoolLexicalRender(t *testing.T) {
+	code1 := `const render = () => '{"html": "<div>1</div>"}';`
+	code2 := `const render = () => '{"html": "<div>2</div>"}';`
+
+	p := NewPool(code1)
+	defer p.Close(context.Background())
+
+	resp, err := p.Render(&Request{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertContains(t, resp.HTML, "1")
+
+	// a bundle declaring render with const is accepted, and renders
+	assertNil(t, p.UpdateCodeWithOptions(code2, UpdateOptions{}))
+	resp, err = p.Render(&Request{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertContains(t, resp.HTML, "2")
+}
+
 func TestPoolRenderTorture(t *testing.T) {
 	threads := 20
 	requests := 5000
@@ -113,3 +474,230 @@ func TestPoolRenderTorture(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestPoolCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reactor")
+	assertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	code := `function render(req) { return JSON.stringify({ html: "<p>cached</p>" }) }`
+	opts := PoolOptions{CacheDir: dir}
+
+	p := NewPoolWithOptions(code, opts)
+	resp, err := p.Render(&Request{})
+	assertNil(t, err)
+	assertEquals(t, "<p>cached</p>", resp.HTML)
+	assertNil(t, p.Close(context.Background()))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, checksum(code)+".codecache"))
+	assertNil(t, err)
+	if len(data) == 0 {
+		t.Fatal("expected code cache data to be written")
+	}
+
+	// a new pool uses the data written by the first
+	p = NewPoolWithOptions(code, opts)
+	resp, err = p.Render(&Request{})
+	assertNil(t, err)
+	assertEquals(t, "<p>cached</p>", resp.HTML)
+	assertNil(t, p.Close(context.Background()))
+}
+
+func TestPoolSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reactor")
+	assertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	code := `var prefix = "snap"; function render(req) { return JSON.stringify({ html: prefix + JSON.parse(req).name }) }`
+	opts := PoolOptions{CacheDir: dir, Snapshots: true}
+
+	p := NewPoolWithOptions(code, opts)
+	resp, err := p.Render(&Request{Name: "shot"})
+	assertNil(t, err)
+	assertEquals(t, "snapshot", resp.HTML)
+	assertNil(t, p.Close(context.Background()))
+
+	files, err := filepath.Glob(filepath.Join(dir, checksum(code)+".*.snapshot"))
+	assertNil(t, err)
+	assertEquals(t, 1, len(files))
+
+	// a new pool creates its workers from the stored snapshot
+	p = NewPoolWithOptions(code, opts)
+	resp, err = p.Render(&Request{Name: "shot"})
+	assertNil(t, err)
+	assertEquals(t, "snapshot", resp.HTML)
+	assertNil(t, p.Close(context.Background()))
+}
+
+func TestPoolSourceMap(t *testing.T) {
+	m, err := ParseSourceMap([]byte(testSourceMap))
+	assertNil(t, err)
+
+	p := NewPool(`function render() { return '{"html": "ok"}'; }`)
+
+	err = p.UpdateCodeWithOptions(testSourceMapCode, UpdateOptions{SourceMap: m})
+	assertNil(t, err)
+	_, err = p.Render(&Request{})
+	assertNotNil(t, err)
+	if err != nil {
+		assertContains(t, err.Error(), "at render (src/App.jsx:10:5)")
+	}
+	mapped := p.Versions()[0].ID
+
+	// code updated without a source map has none
+	p.UpdateCode(testSourceMapCode + "\n")
+	_, err = p.Render(&Request{})
+	assertNotNil(t, err)
+	if err != nil {
+		assertContains(t, err.Error(), "at render (server.js:2:")
+	}
+
+	// rolling back restores the source map of the version
+	assertNil(t, p.Rollback(mapped))
+	_, err = p.Render(&Request{})
+	assertNotNil(t, err)
+	if err != nil {
+		assertContains(t, err.Error(), "at render (src/App.jsx:10:5)")
+	}
+}
+
+func TestPoolComponentErrors(t *testing.T) {
+	p := NewPoolWithOptions(`function render() { return '{"error": "not found"}'; }`, PoolOptions{
+		MaxWorkers: 1,
+		Worker:     WorkerOptions{ComponentErrors: true},
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := p.Render(&Request{Name: "Missing"})
+		assertNotNil(t, resp)
+		if !errors.Is(err, &RenderError{Kind: KindComponent}) {
+			t.Fatalf("expected component error, got %v", err)
+		}
+	}
+
+	// the worker is returned to the pool rather than discarded
+	p.mu.Lock()
+	n := len(p.workers)
+	p.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected 1 idle worker, got %d", n)
+	}
+}
+
+func TestPoolRenderInto(t *testing.T) {
+	p := NewPool(`function render(json) { return JSON.stringify({ name: JSON.parse(json).name }); }`)
+
+	var out map[string]string
+	err := p.RenderInto(context.Background(), &Request{Name: "Widget"}, &out)
+	assertNil(t, err)
+	assertEquals(t, map[string]string{"name": "Widget"}, out)
+}
+
+func TestPoolIgnoresWorkerSnapshot(t *testing.T) {
+	code1 := `function render() { return '{"html": "1"}'; }`
+	code2 := `function render() { return '{"html": "2"}'; }`
+
+	snapshot, err := v8.CreateSnapshot(code1, "server.js")
+	assertNil(t, err)
+
+	p := NewPoolWithOptions(code1, PoolOptions{
+		Worker: WorkerOptions{Snapshot: snapshot},
+	})
+
+	// workers for new code must not be created from the old snapshot
+	p.UpdateCode(code2)
+	resp, err := p.Render(&Request{})
+	assertNil(t, err)
+	if resp != nil && resp.HTML != "2" {
+		t.Fatalf("expected the new code to render, got %q", resp.HTML)
+	}
+}
+
+func TestPoolUpdateCodeMaxWorkers(t *testing.T) {
+	code1 := `function render() { return '{"html": "1"}'; }`
+	code2 := `function render() { return '{"html": "2"}'; }`
+
+	p := NewPoolWithOptions(code1, PoolOptions{MaxWorkers: 2, UpdateWorkers: 2})
+
+	w1, err := p.Get()
+	assertNil(t, err)
+	w2, err := p.Get()
+	assertNil(t, err)
+
+	// both places are busy, so no replacement workers fit
+	p.UpdateCode(code2)
+	p.mu.Lock()
+	if p.size > 2 {
+		t.Errorf("expected at most 2 workers, got %d", p.size)
+	}
+	p.mu.Unlock()
+
+	p.Put(w1)
+	resp, err := p.Render(&Request{})
+	assertNil(t, err)
+	if resp != nil && resp.HTML != "2" {
+		t.Errorf("expected the new code to render, got %q", resp.HTML)
+	}
+
+	// with one place free, one replacement worker is created
+	p.UpdateCode(code1)
+	p.mu.Lock()
+	if p.size > 2 {
+		t.Errorf("expected at most 2 workers, got %d", p.size)
+	}
+	p.mu.Unlock()
+
+	p.Put(w2)
+	p.mu.Lock()
+	if p.size > 2 {
+		t.Errorf("expected at most 2 workers, got %d", p.size)
+	}
+	p.mu.Unlock()
+}
+
+func TestPoolUpdateCodeKeepsIdleWorkers(t *testing.T) {
+	code1 := `function render() { return '{"html": "1"}'; }`
+	code2 := `var start = Date.now(); while (Date.now() - start < 200) {}
+		function render() { return '{"html": "2"}'; }`
+
+	p := NewPoolWithOptions(code1, PoolOptions{MaxWorkers: 2, MinIdle: 2, UpdateWorkers: 2})
+	defer p.Close(context.Background())
+
+	idle := func() int {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.workers)
+	}
+	for idle() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.UpdateCode(code2)
+		close(done)
+	}()
+
+	// the idle workers keep serving while the new code is evaluated
+	time.Sleep(50 * time.Millisecond)
+	if n := idle(); n != 2 {
+		t.Errorf("expected 2 idle workers during the update, got %d", n)
+	}
+	resp, err := p.Render(&Request{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertContains(t, resp.HTML, "1")
+
+	<-done
+	p.mu.Lock()
+	if p.size > 2 {
+		t.Errorf("expected at most 2 workers, got %d", p.size)
+	}
+	p.mu.Unlock()
+	resp, err = p.Render(&Request{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertContains(t, resp.HTML, "2")
+}
@@ -1,6 +1,10 @@
 package reactor
 
 import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
 	"time"
 )
 
@@ -14,6 +18,24 @@ type Renderer interface {
 	Render(*Request) (*Response, error)
 }
 
+// ContextRenderer is an interface for a type capable of rendering a Request
+// while respecting the cancellation and deadline of a context.Context.
+type ContextRenderer interface {
+	RenderContext(context.Context, *Request) (*Response, error)
+}
+
+// IntoRenderer is an interface for a type capable of rendering a Request and
+// decoding the result into an arbitrary Go value.
+type IntoRenderer interface {
+	RenderInto(context.Context, *Request, interface{}) error
+}
+
+// StreamRenderer is an interface for a type capable of rendering a Request as
+// a stream written to an io.Writer.
+type StreamRenderer interface {
+	RenderStream(context.Context, *Request, io.Writer) error
+}
+
 // Request represents a request to be sent to the server.
 type Request struct {
 	// Name is the name of the React component you wish to render. It should
@@ -39,7 +61,72 @@ type Response struct {
 	// related to some failure to render the component.
 	Error string `json:"error,omitempty"`
 
+	// Head is markup for the head of the page, such as the title and meta
+	// tags collected while rendering the component.
+	Head string `json:"head,omitempty"`
+
+	// Status is the HTTP status code the page should be served with, such as
+	// 404 for an unknown route. Zero means the server script did not set one.
+	Status int `json:"status,omitempty"`
+
+	// RedirectURL is the URL the client should be redirected to instead of
+	// being served the page, if any.
+	RedirectURL string `json:"redirect,omitempty"`
+
+	// Headers are HTTP response headers to be served with the page. The
+	// server script may give each header as a string, or as an array of
+	// strings for headers which are repeated, such as Set-Cookie.
+	Headers http.Header `json:"headers,omitempty"`
+
+	// Extra is any other data returned by the server script for the
+	// application, left encoded as JSON.
+	Extra json.RawMessage `json:"extra,omitempty"`
+
+	// Console holds the lines written to the console during the render, if
+	// the worker was created with CaptureConsole.
+	Console []ConsoleMessage `json:"console,omitempty"`
+
 	// Timer is the runtime of the render request, including all time spent in
 	// serialization, routing, and rendering.
 	Timer time.Duration `json:"-"`
 }
+
+// UnmarshalJSON decodes a Response returned by the server script, accepting
+// either a string or an array of strings as the value of each header.
+func (r *Response) UnmarshalJSON(data []byte) error {
+	type response Response
+	var raw struct {
+		*response
+		Headers map[string]headerValues `json:"headers"`
+	}
+	raw.response = (*response)(r)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	r.Headers = nil
+	if raw.Headers != nil {
+		r.Headers = make(http.Header, len(raw.Headers))
+		for key, values := range raw.Headers {
+			for _, value := range values {
+				r.Headers.Add(key, value)
+			}
+		}
+	}
+	return nil
+}
+
+// headerValues holds the values of a header, which are decoded from either a
+// single string or an array of strings.
+type headerValues []string
+
+func (v *headerValues) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, (*[]string)(v)); err == nil {
+		return nil
+	} else if json.Unmarshal(data, &s) != nil {
+		return err
+	}
+	*v = headerValues{s}
+	return nil
+}
@@ -0,0 +1,220 @@
+package reactor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jcoene/reactor/v8"
+)
+
+// SourceMap maps locations in server code generated by a bundler, such as
+// webpack, back to the original source files. When given to a Worker or Pool,
+// the locations of JavaScript errors thrown by the server code, including
+// their stack frames, are rewritten to refer to the original files. Only the
+// version 3 format is supported, without sections.
+type SourceMap struct {
+	sources  []string
+	contents []string
+
+	// lines holds the mappings of each line of the generated code, sorted by
+	// column.
+	lines [][]mapping
+}
+
+// mapping maps a column of the generated code to a location in a source file.
+// Lines and columns are zero-based, and source is -1 for a column which does
+// not map to any source file.
+type mapping struct {
+	column       int
+	source       int
+	sourceLine   int
+	sourceColumn int
+}
+
+// ParseSourceMap parses a source map in the version 3 format.
+func ParseSourceMap(data []byte) (*SourceMap, error) {
+	var raw struct {
+		Version        int               `json:"version"`
+		SourceRoot     string            `json:"sourceRoot"`
+		Sources        []string          `json:"sources"`
+		SourcesContent []*string         `json:"sourcesContent"`
+		Mappings       string            `json:"mappings"`
+		Sections       []json.RawMessage `json:"sections"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid source map: %s", err)
+	}
+	if raw.Version != 3 {
+		return nil, fmt.Errorf("unsupported source map version %d", raw.Version)
+	}
+	if raw.Sections != nil {
+		return nil, errors.New("source maps with sections are not supported")
+	}
+
+	m := &SourceMap{
+		sources:  make([]string, len(raw.Sources)),
+		contents: make([]string, len(raw.Sources)),
+	}
+	for i, source := range raw.Sources {
+		if raw.SourceRoot != "" {
+			source = strings.TrimSuffix(raw.SourceRoot, "/") + "/" + source
+		}
+		m.sources[i] = source
+		if i < len(raw.SourcesContent) && raw.SourcesContent[i] != nil {
+			m.contents[i] = *raw.SourcesContent[i]
+		}
+	}
+
+	if err := m.parseMappings(raw.Mappings); err != nil {
+		return nil, fmt.Errorf("invalid source map: %s", err)
+	}
+	return m, nil
+}
+
+// parseMappings decodes the mappings of the source map, which are grouped by
+// generated line, separated by semicolons. Each mapping is a comma separated
+// segment of base64 VLQ encoded fields, relative to the previous mapping.
+func (m *SourceMap) parseMappings(mappings string) error {
+	var source, sourceLine, sourceColumn int
+	for _, line := range strings.Split(mappings, ";") {
+		var segments []mapping
+		column := 0
+		for _, segment := range strings.Split(line, ",") {
+			if segment == "" {
+				continue
+			}
+			fields, err := decodeVLQ(segment)
+			if err != nil {
+				return err
+			}
+			if len(fields) != 1 && len(fields) != 4 && len(fields) != 5 {
+				return fmt.Errorf("segment %q has %d fields", segment, len(fields))
+			}
+
+			column += fields[0]
+			mp := mapping{column: column, source: -1}
+			if len(fields) > 1 {
+				source += fields[1]
+				sourceLine += fields[2]
+				sourceColumn += fields[3]
+				if source < 0 || source >= len(m.sources) {
+					return fmt.Errorf("segment %q refers to unknown source %d", segment, source)
+				}
+				mp.source = source
+				mp.sourceLine = sourceLine
+				mp.sourceColumn = sourceColumn
+			}
+			segments = append(segments, mp)
+		}
+		sort.SliceStable(segments, func(i, j int) bool {
+			return segments[i].column < segments[j].column
+		})
+		m.lines = append(m.lines, segments)
+	}
+	return nil
+}
+
+// decodeVLQ decodes the base64 VLQ encoded fields of a segment.
+func decodeVLQ(segment string) ([]int, error) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+	var fields []int
+	value, shift := 0, uint(0)
+	for i := 0; i < len(segment); i++ {
+		digit := strings.IndexByte(alphabet, segment[i])
+		if digit < 0 {
+			return nil, fmt.Errorf("segment %q is not base64 encoded", segment)
+		}
+		value += (digit & 31) << shift
+		if digit&32 != 0 {
+			if shift += 5; shift > 30 {
+				return nil, fmt.Errorf("segment %q has a field out of range", segment)
+			}
+			continue
+		}
+		if value&1 != 0 {
+			fields = append(fields, -(value >> 1))
+		} else {
+			fields = append(fields, value>>1)
+		}
+		value, shift = 0, 0
+	}
+	if shift != 0 {
+		return nil, fmt.Errorf("segment %q is truncated", segment)
+	}
+	return fields, nil
+}
+
+// Lookup returns the source file, line and column that the given line and
+// column of the generated code map to, and false if they do not map to any.
+// Lines and columns are one-based.
+func (m *SourceMap) Lookup(line, column int) (string, int, int, bool) {
+	mp, ok := m.lookup(line, column)
+	if !ok {
+		return "", 0, 0, false
+	}
+	return m.sources[mp.source], mp.sourceLine + 1, mp.sourceColumn + 1, true
+}
+
+// lookup returns the mapping for the given one-based line and column of the
+// generated code: the last on the line starting at or before the column.
+func (m *SourceMap) lookup(line, column int) (mapping, bool) {
+	if line < 1 || line > len(m.lines) {
+		return mapping{}, false
+	}
+	segments := m.lines[line-1]
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].column > column-1
+	})
+	if i == 0 || segments[i-1].source < 0 {
+		return mapping{}, false
+	}
+	return segments[i-1], true
+}
+
+// sourceLine returns the given zero-based line of a source file, if its
+// contents are included in the source map.
+func (m *SourceMap) sourceLine(source, line int) string {
+	content := m.contents[source]
+	for ; line > 0; line-- {
+		i := strings.IndexByte(content, '\n')
+		if i < 0 {
+			return ""
+		}
+		content = content[i+1:]
+	}
+	if i := strings.IndexByte(content, '\n'); i >= 0 {
+		content = content[:i]
+	}
+	return strings.TrimSuffix(content, "\r")
+}
+
+// rewrite rewrites the locations of a JavaScript error thrown by the server
+// code to refer to the original source files. Other errors, and all errors
+// given a nil SourceMap, are returned as they are.
+func (m *SourceMap) rewrite(err error) error {
+	var jsErr *v8.JSError
+	if m == nil || !errors.As(err, &jsErr) {
+		return err
+	}
+
+	mp, located := mapping{}, false
+	if jsErr.ScriptName == serverScriptName {
+		mp, located = m.lookup(jsErr.Line, jsErr.Column)
+	}
+
+	jsErr.MapLocations(func(scriptName string, line, column int) (string, int, int, bool) {
+		if scriptName != serverScriptName {
+			return "", 0, 0, false
+		}
+		return m.Lookup(line, column)
+	})
+
+	if located {
+		jsErr.SourceLine = m.sourceLine(mp.source, mp.sourceLine)
+	}
+	return err
+}
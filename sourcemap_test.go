@@ -0,0 +1,71 @@
+package reactor
+
+import (
+	"testing"
+)
+
+// testSourceMap maps line 2 of testSourceMapCode, from its third column, to
+// line 10 of src/App.jsx, from its fifth column.
+const testSourceMap = `{
+	"version": 3,
+	"file": "server.js",
+	"sources": ["App.jsx"],
+	"sourceRoot": "src/",
+	"sourcesContent": ["// 1\n// 2\n// 3\n// 4\n// 5\n// 6\n// 7\n// 8\nfunction render() {\n    throw new Error(\"boom\");\n}\n"],
+	"names": [],
+	"mappings": ";EASI"
+}`
+
+const testSourceMapCode = "function render(json) {\n  throw new Error(\"boom\");\n}\n"
+
+func TestParseSourceMap(t *testing.T) {
+	m, err := ParseSourceMap([]byte(testSourceMap))
+	assertNil(t, err)
+	if m == nil {
+		t.FailNow()
+	}
+
+	source, line, column, ok := m.Lookup(2, 3)
+	assertEquals(t, true, ok)
+	assertEquals(t, "src/App.jsx", source)
+	assertEquals(t, 10, line)
+	assertEquals(t, 5, column)
+
+	// later columns map to the preceding segment
+	_, line, column, ok = m.Lookup(2, 9)
+	assertEquals(t, true, ok)
+	assertEquals(t, 10, line)
+	assertEquals(t, 5, column)
+
+	for _, pos := range [][2]int{{1, 1}, {2, 1}, {3, 1}, {100, 1}} {
+		_, _, _, ok = m.Lookup(pos[0], pos[1])
+		assertEquals(t, false, ok)
+	}
+
+	assertEquals(t, `    throw new Error("boom");`, m.sourceLine(0, 9))
+	assertEquals(t, "", m.sourceLine(0, 100))
+
+	invalid := []string{
+		`not json`,
+		`{"version": 2, "sources": [], "mappings": ""}`,
+		`{"version": 3, "sections": []}`,
+		`{"version": 3, "sources": [], "mappings": "AAAA"}`,
+		`{"version": 3, "sources": ["a.js"], "mappings": "AA"}`,
+		`{"version": 3, "sources": ["a.js"], "mappings": "A!AA"}`,
+		`{"version": 3, "sources": ["a.js"], "mappings": "g"}`,
+	}
+	for _, data := range invalid {
+		_, err := ParseSourceMap([]byte(data))
+		assertNotNil(t, err)
+	}
+}
+
+func TestDecodeVLQ(t *testing.T) {
+	fields, err := decodeVLQ("AAgBC")
+	assertNil(t, err)
+	assertEquals(t, []int{0, 0, 16, 1}, fields)
+
+	fields, err = decodeVLQ("D")
+	assertNil(t, err)
+	assertEquals(t, []int{-1}, fields)
+}
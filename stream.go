@@ -0,0 +1,69 @@
+package reactor
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// errStreamClosed is thrown by the write function of a streaming render once
+// RenderStream has returned.
+var errStreamClosed = errors.New("stream closed")
+
+// flusher is implemented by writers which buffer output, such as
+// http.ResponseWriter.
+type flusher interface {
+	Flush()
+}
+
+// errorFlusher is implemented by writers which buffer output and may fail to
+// flush it, such as bufio.Writer.
+type errorFlusher interface {
+	Flush() error
+}
+
+// streamWriter writes the chunks of a streaming render to an io.Writer. Once
+// closed, further chunks are rejected, so the writer is never used after
+// RenderStream returns, even by a render which is still being terminated.
+type streamWriter struct {
+	w      io.Writer
+	closed bool
+	err    error
+	mu     sync.Mutex
+}
+
+// write writes the chunk and flushes the writer. Once a write has failed,
+// its error is returned for every later chunk.
+func (s *streamWriter) write(chunk string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errStreamClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+
+	_, err := io.WriteString(s.w, chunk)
+	if err == nil {
+		switch f := s.w.(type) {
+		case flusher:
+			f.Flush()
+		case errorFlusher:
+			err = f.Flush()
+		}
+	}
+	s.err = err
+	return err
+}
+
+// close rejects any further chunks, waiting for a write in progress, and
+// returns the error of the write which failed, if any.
+func (s *streamWriter) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return s.err
+}
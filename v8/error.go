@@ -0,0 +1,239 @@
+package v8
+
+// #include <stdlib.h>
+// #include "v8_c_bridge.h"
+import "C"
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// JSError is an exception thrown by JavaScript, or the reason a promise was
+// rejected.
+type JSError struct {
+	// Message is the message of the Error thrown, or the thrown value as a
+	// string if it was not an object.
+	Message string
+
+	// Name is the name of the Error thrown, such as "TypeError", if any.
+	Name string
+
+	// ScriptName, Line and Column give the location the exception was thrown
+	// from, if known. Line and Column are one-based.
+	ScriptName string
+	Line       int
+	Column     int
+
+	// SourceLine is the line of source code at Line.
+	SourceLine string
+
+	// Stack is the stack property of the Error thrown, if any, and
+	// StackFrames the frames parsed from it, innermost first.
+	Stack       string
+	StackFrames []StackFrame
+
+	// text is the thrown value as a string, span the length of the source
+	// code highlighted at the location, and stackText the stack property as
+	// a string even if it was not one.
+	text      string
+	located   bool
+	span      int
+	hasStack  bool
+	stackText string
+}
+
+// StackFrame is a frame of the stack trace of a JSError.
+type StackFrame struct {
+	// Function is the name of the function, which is empty for anonymous
+	// functions and top-level code.
+	Function string
+
+	// ScriptName, Line and Column give the location within the function.
+	// Line and Column are one-based, and zero if unknown.
+	ScriptName string
+	Line       int
+	Column     int
+}
+
+// Error formats the exception as "Uncaught exception: " followed by the
+// thrown value, its location with the source line highlighted, and its stack
+// trace.
+func (e *JSError) Error() string {
+	var b strings.Builder
+	b.WriteString("Uncaught exception: ")
+	b.WriteString(e.text)
+
+	if e.located {
+		start := e.Column - 1
+		if start < 0 {
+			start = 0
+		}
+		b.WriteString("\nat ")
+		b.WriteString(e.ScriptName)
+		b.WriteString(":")
+		b.WriteString(strconv.Itoa(e.Line))
+		b.WriteString(":")
+		b.WriteString(strconv.Itoa(start))
+
+		// The source line is unknown if the location was mapped to a file
+		// whose source is not available.
+		if e.SourceLine != "" {
+			span := e.span
+			if max := len(e.SourceLine) - start; span > max {
+				span = max
+			}
+			if span < 0 {
+				span = 0
+			}
+			b.WriteString("\n  ")
+			b.WriteString(e.SourceLine)
+			b.WriteString("\n  ")
+			b.WriteString(strings.Repeat(" ", start))
+			b.WriteString(strings.Repeat("^", span))
+		}
+	}
+
+	if e.hasStack {
+		b.WriteString("\nStack trace: ")
+		if e.Stack != "" {
+			b.WriteString(e.Stack)
+		} else {
+			b.WriteString(e.stackText)
+		}
+	}
+
+	return b.String()
+}
+
+// decodeError returns the error described by exc if the error is a JavaScript
+// exception, or by e otherwise. Both are freed.
+func decodeError(e C.String, exc *C.Exception) error {
+	if exc != nil {
+		takeString(e)
+		return newJSError(exc)
+	}
+	if e.ptr == nil {
+		return nil
+	}
+	return errors.New(takeString(e))
+}
+
+// MapLocations rewrites the location of the exception, along with those of
+// its stack frames, using fn, which returns the original script name, line
+// and column of a location in generated code, or false to leave it as it is.
+// Lines and columns are one-based. It is used to apply source maps. The
+// SourceLine of a mapped location is cleared, as it is a line of the
+// generated code.
+func (e *JSError) MapLocations(fn func(scriptName string, line, column int) (string, int, int, bool)) {
+	if e.located {
+		if name, line, column, ok := fn(e.ScriptName, e.Line, e.Column); ok {
+			e.ScriptName, e.Line, e.Column = name, line, column
+			e.SourceLine = ""
+		}
+	}
+
+	if e.Stack == "" {
+		return
+	}
+	lines := strings.Split(e.Stack, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), "at ") {
+			continue
+		}
+		m := stackFrameRE.FindStringSubmatchIndex(line)
+		if m == nil || m[6] < 0 || m[8] < 0 {
+			continue
+		}
+		ln, _ := strconv.Atoi(line[m[6]:m[7]])
+		col, _ := strconv.Atoi(line[m[8]:m[9]])
+		name, ln, col, ok := fn(line[m[4]:m[5]], ln, col)
+		if !ok {
+			continue
+		}
+		lines[i] = line[:m[4]] + name + ":" + strconv.Itoa(ln) + ":" + strconv.Itoa(col) + line[m[9]:]
+	}
+	e.Stack = strings.Join(lines, "\n")
+	e.StackFrames = parseStack(e.Stack)
+}
+
+// newJSError creates a JSError from the given Exception, which is freed.
+func newJSError(exc *C.Exception) *JSError {
+	defer C.free(unsafe.Pointer(exc))
+
+	e := &JSError{
+		text:     takeString(exc.text),
+		Name:     takeString(exc.name),
+		Message:  takeString(exc.message),
+		located:  exc.has_location != 0,
+		hasStack: exc.has_stack != 0,
+	}
+
+	script := takeString(exc.script_name)
+	source := takeString(exc.source_line)
+	if e.located {
+		e.ScriptName = script
+		e.Line = int(exc.line)
+		e.Column = int(exc.start_column) + 1
+		e.SourceLine = source
+		if span := int(exc.end_column - exc.start_column); span > 0 {
+			e.span = span
+		}
+	}
+
+	stack := takeString(exc.stack)
+	if e.hasStack {
+		e.stackText = stack
+		if exc.stack_is_string != 0 {
+			e.Stack = stack
+			e.StackFrames = parseStack(stack)
+		}
+	}
+
+	return e
+}
+
+// takeString returns the given String as a Go string, freeing it.
+func takeString(s C.String) string {
+	if s.ptr == nil {
+		return ""
+	}
+	gs := C.GoStringN(s.ptr, s.len)
+	C.free(unsafe.Pointer(s.ptr))
+	return gs
+}
+
+// stackFrameRE matches a frame of a V8 stack trace, such as
+// "    at render (server.js:10:5)" or "    at server.js:1:1".
+var stackFrameRE = regexp.MustCompile(`^\s*at (?:(.*?) \()?(.*?)(?::(\d+))?(?::(\d+))?\)?$`)
+
+// parseStack parses the frames of a V8 stack trace, which follow the line
+// with the name and message of the Error.
+func parseStack(stack string) []StackFrame {
+	var frames []StackFrame
+	for _, line := range strings.Split(stack, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "at ") {
+			continue
+		}
+		m := stackFrameRE.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		frame := StackFrame{
+			Function:   m[1],
+			ScriptName: m[2],
+		}
+		frame.Line, _ = strconv.Atoi(m[3])
+		frame.Column, _ = strconv.Atoi(m[4])
+		if m[1] == "" && m[3] == "" {
+			// A frame without a location, such as "at Array.map (native)"
+			// without the parentheses, names only the function.
+			frame.Function, frame.ScriptName = frame.ScriptName, ""
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
@@ -0,0 +1,366 @@
+package v8
+
+// #include "v8_c_bridge.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// maxExportDepth limits the nesting of values converted by Export, which
+// would otherwise recurse forever on cyclic objects.
+const maxExportDepth = 1000
+
+// Export converts the Value into the Go value pointed to by into, without
+// encoding it as JSON. Conversion follows the rules of encoding/json:
+// booleans, numbers and strings convert to the matching Go kinds, arrays to
+// slices and arrays, and objects to string-keyed maps or structs, whose
+// fields are matched by their json tag or name. Values converted into an
+// empty interface become bool, float64, string, []interface{} or
+// map[string]interface{}. Null and undefined convert to the zero value.
+func (val *Value) Export(into interface{}) error {
+	rv := reflect.ValueOf(into)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("v8: Export requires a non-nil pointer, got %T", into)
+	}
+
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		return nil
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return ErrReleasedContext
+	}
+
+	return val.export(rv.Elem(), 0)
+}
+
+// export converts the Value into rv. The caller must hold the Context lock.
+func (val *Value) export(rv reflect.Value, depth int) error {
+	if depth > maxExportDepth {
+		return errors.New("v8: value nested too deeply to export")
+	}
+
+	kind := val.kindLocked()
+	if kind&(C.V8_KIND_UNDEFINED|C.V8_KIND_NULL) != 0 {
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return val.export(rv.Elem(), depth+1)
+
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return exportError(kind, rv.Type())
+		}
+		v, err := val.exportInterface(kind, depth)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			rv.Set(reflect.Zero(rv.Type()))
+		} else {
+			rv.Set(reflect.ValueOf(v))
+		}
+		return nil
+
+	case reflect.Bool:
+		if kind&C.V8_KIND_BOOLEAN == 0 {
+			return exportError(kind, rv.Type())
+		}
+		rv.SetBool(C.V8_Value_Bool(val.ctx.ptr, val.ptr) != 0)
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if kind&C.V8_KIND_NUMBER == 0 {
+			return exportError(kind, rv.Type())
+		}
+		f := float64(C.V8_Value_Float64(val.ctx.ptr, val.ptr))
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || rv.OverflowInt(int64(f)) {
+			return fmt.Errorf("v8: cannot export number %v into Go value of type %s", f, rv.Type())
+		}
+		rv.SetInt(int64(f))
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if kind&C.V8_KIND_NUMBER == 0 {
+			return exportError(kind, rv.Type())
+		}
+		f := float64(C.V8_Value_Float64(val.ctx.ptr, val.ptr))
+		if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || rv.OverflowUint(uint64(f)) {
+			return fmt.Errorf("v8: cannot export number %v into Go value of type %s", f, rv.Type())
+		}
+		rv.SetUint(uint64(f))
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		if kind&C.V8_KIND_NUMBER == 0 {
+			return exportError(kind, rv.Type())
+		}
+		f := float64(C.V8_Value_Float64(val.ctx.ptr, val.ptr))
+		if rv.OverflowFloat(f) {
+			return fmt.Errorf("v8: cannot export number %v into Go value of type %s", f, rv.Type())
+		}
+		rv.SetFloat(f)
+		return nil
+
+	case reflect.String:
+		if kind&C.V8_KIND_STRING == 0 {
+			return exportError(kind, rv.Type())
+		}
+		rv.SetString(val.stringLocked())
+		return nil
+
+	case reflect.Slice:
+		if kind&C.V8_KIND_ARRAY == 0 {
+			return exportError(kind, rv.Type())
+		}
+		n := val.lengthLocked()
+		s := reflect.MakeSlice(rv.Type(), n, n)
+		if err := val.exportElements(s, n, depth); err != nil {
+			return err
+		}
+		rv.Set(s)
+		return nil
+
+	case reflect.Array:
+		if kind&C.V8_KIND_ARRAY == 0 {
+			return exportError(kind, rv.Type())
+		}
+		n := val.lengthLocked()
+		if n > rv.Len() {
+			n = rv.Len()
+		}
+		rv.Set(reflect.Zero(rv.Type()))
+		return val.exportElements(rv, n, depth)
+
+	case reflect.Map:
+		if kind&C.V8_KIND_OBJECT == 0 || rv.Type().Key().Kind() != reflect.String {
+			return exportError(kind, rv.Type())
+		}
+		keys, err := val.keysLocked()
+		if err != nil {
+			return err
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMapWithSize(rv.Type(), len(keys)))
+		}
+		for _, key := range keys {
+			ev := reflect.New(rv.Type().Elem()).Elem()
+			if err := val.exportProperty(key, ev, depth); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), ev)
+		}
+		return nil
+
+	case reflect.Struct:
+		if kind&C.V8_KIND_OBJECT == 0 {
+			return exportError(kind, rv.Type())
+		}
+		keys, err := val.keysLocked()
+		if err != nil {
+			return err
+		}
+		for _, f := range exportFields(rv.Type()) {
+			key, ok := matchKey(keys, f.name)
+			if !ok {
+				continue
+			}
+			fv, err := fieldByIndex(rv, f.index)
+			if err != nil {
+				return err
+			}
+			if err := val.exportProperty(key, fv, depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return exportError(kind, rv.Type())
+}
+
+// exportElements converts the first n elements of an array into the
+// elements of rv, which must be a slice or array.
+func (val *Value) exportElements(rv reflect.Value, n, depth int) error {
+	for i := 0; i < n; i++ {
+		el, err := val.indexLocked(i)
+		if err != nil {
+			return err
+		}
+		err = el.export(rv.Index(i), depth+1)
+		el.releaseLocked()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportProperty converts the named property of an object into rv.
+func (val *Value) exportProperty(key string, rv reflect.Value, depth int) error {
+	prop, err := val.getLocked(key)
+	if err != nil {
+		return err
+	}
+	defer prop.releaseLocked()
+
+	return prop.export(rv, depth+1)
+}
+
+// exportInterface converts the Value into the Go type used for it by
+// encoding/json when decoding into an empty interface.
+func (val *Value) exportInterface(kind C.int, depth int) (interface{}, error) {
+	switch {
+	case kind&C.V8_KIND_BOOLEAN != 0:
+		var b bool
+		err := val.export(reflect.ValueOf(&b).Elem(), depth+1)
+		return b, err
+	case kind&C.V8_KIND_NUMBER != 0:
+		var f float64
+		err := val.export(reflect.ValueOf(&f).Elem(), depth+1)
+		return f, err
+	case kind&C.V8_KIND_STRING != 0:
+		return val.stringLocked(), nil
+	case kind&C.V8_KIND_ARRAY != 0:
+		var s []interface{}
+		err := val.export(reflect.ValueOf(&s).Elem(), depth+1)
+		return s, err
+	case kind&C.V8_KIND_FUNCTION != 0:
+		return nil, exportError(kind, reflect.TypeOf((*interface{})(nil)).Elem())
+	case kind&C.V8_KIND_OBJECT != 0:
+		var m map[string]interface{}
+		err := val.export(reflect.ValueOf(&m).Elem(), depth+1)
+		return m, err
+	}
+	return nil, nil
+}
+
+// exportField is a struct field which may be set by Export.
+type exportField struct {
+	name  string
+	index []int
+}
+
+// exportFields returns the fields of a struct type which may be set by
+// Export, including those promoted from embedded structs, named as they
+// would be by encoding/json.
+func exportFields(t reflect.Type) []exportField {
+	var fields []exportField
+	seen := make(map[string]bool)
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		var embedded [][]int
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			tag := sf.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name := strings.Split(tag, ",")[0]
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+				embedded = append(embedded, append(append([]int{}, index...), i))
+				continue
+			}
+			if sf.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			fields = append(fields, exportField{name: name, index: append(append([]int{}, index...), i)})
+		}
+		// Fields of embedded structs are shadowed by those of the outer one.
+		for _, idx := range embedded {
+			ft := t.Field(idx[len(idx)-1]).Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			walk(ft, idx)
+		}
+	}
+	walk(t, nil)
+	return fields
+}
+
+// fieldByIndex returns the nested field of rv at index, allocating any nil
+// embedded struct pointers along the way.
+func fieldByIndex(rv reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				if !rv.CanSet() {
+					return reflect.Value{}, fmt.Errorf("v8: cannot set embedded pointer to unexported struct type %s", rv.Type().Elem())
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, nil
+}
+
+// matchKey returns the property among keys which matches name, preferring
+// an exact match over a case-insensitive one.
+func matchKey(keys []string, name string) (string, bool) {
+	for _, key := range keys {
+		if key == name {
+			return key, true
+		}
+	}
+	for _, key := range keys {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// exportError returns the error for a Value of the given kind which cannot
+// be converted into the Go type t.
+func exportError(kind C.int, t reflect.Type) error {
+	return fmt.Errorf("v8: cannot export %s into Go value of type %s", kindName(kind), t)
+}
+
+// kindName returns the JavaScript name for the type of a Value of the given
+// kind.
+func kindName(kind C.int) string {
+	switch {
+	case kind&C.V8_KIND_UNDEFINED != 0:
+		return "undefined"
+	case kind&C.V8_KIND_NULL != 0:
+		return "null"
+	case kind&C.V8_KIND_STRING != 0:
+		return "string"
+	case kind&C.V8_KIND_NUMBER != 0:
+		return "number"
+	case kind&C.V8_KIND_BOOLEAN != 0:
+		return "boolean"
+	case kind&C.V8_KIND_ARRAY != 0:
+		return "array"
+	case kind&C.V8_KIND_FUNCTION != 0:
+		return "function"
+	}
+	return "object"
+}
@@ -0,0 +1,148 @@
+package v8
+
+// #include <stdlib.h>
+// #include "v8_c_bridge.h"
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// Function is a Go function which may be called from JavaScript. The
+// arguments are only valid for the duration of the call, and are released
+// once it returns. Ownership of the returned Value, if any, passes to
+// JavaScript: it is released once the call returns, and must not be used
+// afterwards. A returned error is thrown as a JavaScript Error with the same
+// message.
+//
+// A Function runs on the goroutine executing the script which called it,
+// and may use its Context and Values from that goroutine only.
+type Function func(args []*Value) (*Value, error)
+
+// registry maps Context ids to Contexts with bound functions, so that they
+// can be found when called from JavaScript.
+var registry = struct {
+	contexts map[int]*Context
+	sync.Mutex
+}{
+	contexts: make(map[int]*Context),
+}
+
+// Bind makes the given Function callable from JavaScript as a property of
+// the global object. The name may be a dotted path such as "console.log", in
+// which case any missing intermediate objects are created. An error is
+// returned if the function cannot be set, such as when an object on the path
+// is frozen or a getter on it throws.
+//
+// A Context with bound functions is retained until it is released, and so
+// must be manually released to avoid leaking it.
+func (ctx *Context) Bind(name string, fn Function) error {
+	defer ctx.lock()()
+
+	if ctx.ptr == nil {
+		return ErrReleasedContext
+	}
+
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	val, err := ctx.decodeResult(C.V8_Context_Bind(ctx.ptr, c_name, ctx.register(fn)))
+	val.releaseLocked()
+	return err
+}
+
+// NewFunction creates a JavaScript function Value which calls the given
+// Function. The returned Value must be manually released to avoid leaking
+// references. As with Bind, the Context is retained until it is released.
+func (ctx *Context) NewFunction(fn Function) (*Value, error) {
+	defer ctx.lock()()
+
+	if ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	return ctx.decodeResult(C.V8_Context_NewFunction(ctx.ptr, ctx.register(fn)))
+}
+
+// register records the Function, returning the callback id with which it
+// may be called from JavaScript.
+func (ctx *Context) register(fn Function) C.int {
+	registry.Lock()
+	registry.contexts[ctx.id] = ctx
+	registry.Unlock()
+
+	ctx.functionsMu.Lock()
+	defer ctx.functionsMu.Unlock()
+
+	ctx.functions = append(ctx.functions, fn)
+	return C.int(len(ctx.functions) - 1)
+}
+
+// unregister forgets the Context, allowing it to be garbage collected.
+func unregister(ctx *Context) {
+	registry.Lock()
+	delete(registry.contexts, ctx.id)
+	registry.Unlock()
+}
+
+// call calls the Function with the given callback id, recovering from any
+// panic and returning it as an error instead, as it must not unwind through
+// the V8 stack.
+func (ctx *Context) call(id int, args []*Value) (val *Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			val, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	ctx.functionsMu.RLock()
+	fn := ctx.functions[id]
+	ctx.functionsMu.RUnlock()
+
+	return fn(args)
+}
+
+//export goCallback
+func goCallback(contextID C.int, callbackID C.int, argv *C.ValuePtr, argc C.int) C.Result {
+	var res C.Result
+
+	registry.Lock()
+	ctx := registry.contexts[int(contextID)]
+	registry.Unlock()
+
+	if ctx == nil {
+		res.e.ptr = C.CString(ErrReleasedContext.Error())
+		res.e.len = C.int(len(ErrReleasedContext.Error()))
+		return res
+	}
+
+	ptrs := (*[1 << 28]C.ValuePtr)(unsafe.Pointer(argv))[:argc:argc]
+	args := make([]*Value, argc)
+	for i, ptr := range ptrs {
+		args[i] = &Value{ctx: ctx, ptr: ptr}
+	}
+	defer func() {
+		for _, arg := range args {
+			arg.releaseLocked()
+		}
+	}()
+
+	val, err := ctx.call(int(callbackID), args)
+	if err != nil {
+		val.releaseLocked()
+		msg := err.Error()
+		res.e.ptr = C.CString(msg)
+		res.e.len = C.int(len(msg))
+		return res
+	}
+	if val != nil && val.ctx == ctx {
+		// The bridge releases the value once it has been returned, so it
+		// must not be released again from Go, even if it is an argument.
+		res.v_ptr = val.ptr
+		val.ctx, val.ptr = nil, nil
+	}
+
+	return res
+}
@@ -0,0 +1,302 @@
+package v8
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// loopScript installs the timer functions on the global object. Callbacks
+// and their arguments are kept in JavaScript, while the schedule is kept by
+// the EventLoop in Go, which fires timers by id.
+const loopScript = `(function(global, schedule, cancel) {
+	var slice = Array.prototype.slice;
+	var callbacks = {};
+	var nextId = 1;
+
+	function add(fn, delay, args, repeat) {
+		if (typeof fn !== "function") {
+			throw new TypeError("callback must be a function");
+		}
+		var id = nextId++;
+		callbacks[id] = { fn: fn, args: args, repeat: repeat };
+		schedule(id, delay, repeat);
+		return id;
+	}
+
+	function clear(id) {
+		if (callbacks.hasOwnProperty(id)) {
+			delete callbacks[id];
+			cancel(id);
+		}
+	}
+
+	global.setTimeout = function(fn, delay) {
+		return add(fn, Math.max(0, +delay || 0), slice.call(arguments, 2), false);
+	};
+	global.setInterval = function(fn, delay) {
+		return add(fn, Math.max(1, +delay || 0), slice.call(arguments, 2), true);
+	};
+	global.setImmediate = function(fn) {
+		return add(fn, 0, slice.call(arguments, 1), false);
+	};
+	global.clearTimeout = clear;
+	global.clearInterval = clear;
+	global.clearImmediate = clear;
+
+	return {
+		fire: function(id) {
+			var cb = callbacks[id];
+			if (!cb) {
+				return;
+			}
+			if (!cb.repeat) {
+				delete callbacks[id];
+			}
+			cb.fn.apply(global, cb.args);
+		},
+		reset: function() {
+			callbacks = {};
+		},
+	};
+})`
+
+// EventLoop implements the timer functions setTimeout, setInterval and
+// setImmediate, along with their clear functions, for a Context. Timers are
+// kept in Go and only run while the loop is driven by Run or RunDue.
+type EventLoop struct {
+	ctx   *Context
+	fire  *Value
+	reset *Value
+
+	timers map[int64]*timer
+	seq    uint64
+	mu     sync.Mutex
+}
+
+// timer is a callback scheduled by one of the timer functions.
+type timer struct {
+	id       int64
+	when     time.Time
+	interval time.Duration
+	repeat   bool
+
+	// seq orders timers due at the same time by when they were scheduled.
+	seq uint64
+}
+
+// EventLoop returns the event loop of the Context, installing the timer
+// functions on the global object the first time it is called.
+func (ctx *Context) EventLoop() (*EventLoop, error) {
+	ctx.loopMu.Lock()
+	defer ctx.loopMu.Unlock()
+
+	if ctx.loop != nil {
+		return ctx.loop, nil
+	}
+
+	l := &EventLoop{
+		ctx:    ctx,
+		timers: make(map[int64]*timer),
+	}
+	if err := l.install(); err != nil {
+		return nil, err
+	}
+
+	ctx.loop = l
+	return l, nil
+}
+
+// install evaluates loopScript, binding it to the EventLoop.
+func (l *EventLoop) install() error {
+	install, err := l.ctx.Eval(loopScript, "")
+	if err != nil {
+		return err
+	}
+	defer install.Release()
+
+	schedule, err := l.ctx.NewFunction(l.schedule)
+	if err != nil {
+		return err
+	}
+	defer schedule.Release()
+
+	cancel, err := l.ctx.NewFunction(l.cancel)
+	if err != nil {
+		return err
+	}
+	defer cancel.Release()
+
+	global, err := l.ctx.Eval("this", "")
+	if err != nil {
+		return err
+	}
+	defer global.Release()
+
+	fns, err := install.Call(global, schedule, cancel)
+	if err != nil {
+		return err
+	}
+	defer fns.Release()
+
+	if l.fire, err = fns.Get("fire"); err != nil {
+		return err
+	}
+	if l.reset, err = fns.Get("reset"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// schedule is called from JavaScript with the id, delay in milliseconds and
+// whether to repeat a new timer.
+func (l *EventLoop) schedule(args []*Value) (*Value, error) {
+	if len(args) != 3 {
+		return nil, errors.New("schedule expects 3 arguments")
+	}
+
+	delay := time.Duration(args[1].Float64() * float64(time.Millisecond))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	t := &timer{
+		id:     args[0].Int64(),
+		when:   time.Now().Add(delay),
+		repeat: args[2].Bool(),
+		seq:    l.seq,
+	}
+	if t.repeat {
+		t.interval = delay
+	}
+	l.timers[t.id] = t
+
+	return nil, nil
+}
+
+// cancel is called from JavaScript with the id of a cleared timer.
+func (l *EventLoop) cancel(args []*Value) (*Value, error) {
+	if len(args) != 1 {
+		return nil, errors.New("cancel expects 1 argument")
+	}
+
+	l.mu.Lock()
+	delete(l.timers, args[0].Int64())
+	l.mu.Unlock()
+
+	return nil, nil
+}
+
+// Len returns the number of pending timers.
+func (l *EventLoop) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.timers)
+}
+
+// next returns the time the earliest pending timer is due, if any.
+func (l *EventLoop) next() (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var next time.Time
+	for _, t := range l.timers {
+		if next.IsZero() || t.when.Before(next) {
+			next = t.when
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// RunDue runs the timers which are due, in the order they are due. Timers
+// scheduled while doing so are left for a later call, even if they are due
+// immediately. If a timer callback throws, the error is returned and the
+// remaining timers are left pending.
+func (l *EventLoop) RunDue() error {
+	now := time.Now()
+
+	l.mu.Lock()
+	var due []*timer
+	for _, t := range l.timers {
+		if !t.when.After(now) {
+			due = append(due, t)
+		}
+	}
+	l.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].when.Equal(due[j].when) {
+			return due[i].when.Before(due[j].when)
+		}
+		return due[i].seq < due[j].seq
+	})
+
+	for _, t := range due {
+		l.mu.Lock()
+		if l.timers[t.id] != t {
+			// Cleared by an earlier callback.
+			l.mu.Unlock()
+			continue
+		}
+		if t.repeat {
+			t.when = now.Add(t.interval)
+		} else {
+			delete(l.timers, t.id)
+		}
+		l.mu.Unlock()
+
+		val, err := l.fire.Call(t.id)
+		val.Release()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run runs timers as they become due until done reports true or no timers
+// remain. If ctx is done first, ctx.Err() is returned. Run does not
+// interrupt a timer callback which is running; use TerminateExecution for
+// that. A nil done runs until no timers remain.
+func (l *EventLoop) Run(ctx context.Context, done func() bool) error {
+	for done == nil || !done() {
+		next, ok := l.next()
+		if !ok {
+			return nil
+		}
+
+		if d := time.Until(next); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := l.RunDue(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Clear cancels all pending timers.
+func (l *EventLoop) Clear() error {
+	l.mu.Lock()
+	l.timers = make(map[int64]*timer)
+	l.mu.Unlock()
+
+	val, err := l.reset.Call()
+	val.Release()
+	return err
+}
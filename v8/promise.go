@@ -0,0 +1,90 @@
+package v8
+
+// #include <stdlib.h>
+// #include "v8_c_bridge.h"
+import "C"
+
+import "errors"
+
+// ErrPromisePending is returned when the result of a promise which has not
+// yet settled is requested.
+var ErrPromisePending = errors.New("promise is pending")
+
+// PromiseState is the state of a promise.
+type PromiseState int
+
+const (
+	PromisePending PromiseState = iota
+	PromiseFulfilled
+	PromiseRejected
+)
+
+func (s PromiseState) String() string {
+	switch s {
+	case PromisePending:
+		return "pending"
+	case PromiseFulfilled:
+		return "fulfilled"
+	case PromiseRejected:
+		return "rejected"
+	}
+	return "invalid"
+}
+
+// RunMicrotasks runs all pending microtasks, such as promise reactions. They
+// are run automatically whenever a call into the Context returns, so this is
+// only needed after settling promises from outside of JavaScript.
+func (ctx *Context) RunMicrotasks() error {
+	defer ctx.lock()()
+
+	if ctx.ptr == nil {
+		return ErrReleasedContext
+	}
+
+	val, err := ctx.exec(func() C.Result {
+		return C.V8_Context_RunMicrotasks(ctx.ptr)
+	})
+	val.releaseLocked()
+	return err
+}
+
+// PromiseState returns the state of a promise. Values which are not promises
+// are considered fulfilled.
+func (val *Value) PromiseState() PromiseState {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return PromiseFulfilled
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return PromiseFulfilled
+	}
+
+	if state := C.V8_Value_PromiseState(val.ctx.ptr, val.ptr); state >= 0 {
+		return PromiseState(state)
+	}
+	return PromiseFulfilled
+}
+
+// PromiseResult returns the value a settled promise was fulfilled with. If it was
+// rejected, the reason is returned as an error formatted like an uncaught
+// exception, and if it is still pending, ErrPromisePending is returned. The
+// returned Value must be manually released to avoid leaking references.
+func (val *Value) PromiseResult() (*Value, error) {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return nil, ErrReleasedContext
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	if C.V8_Value_PromiseState(val.ctx.ptr, val.ptr) == C.int(PromisePending) {
+		return nil, ErrPromisePending
+	}
+
+	return val.ctx.exec(func() C.Result {
+		return C.V8_Value_PromiseResult(val.ctx.ptr, val.ptr)
+	})
+}
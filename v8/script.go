@@ -0,0 +1,144 @@
+package v8
+
+// #include <stdlib.h>
+// #include "v8_c_bridge.h"
+import "C"
+
+import (
+	"unsafe"
+)
+
+// Script is code compiled inside of a Context, which may be run any number
+// of times without being compiled again. It must be manually released to
+// avoid leaking references.
+type Script struct {
+	ptr C.ScriptPtr
+	ctx *Context
+
+	cachedData []byte
+	rejected   bool
+}
+
+// CompileOptions configures the compilation of a Script.
+type CompileOptions struct {
+	// CachedData is code cache data produced by compiling the same code,
+	// possibly in another Context or process, which is used in place of
+	// parsing and compiling the code. Data produced for different code, or by
+	// a different version of V8, is rejected and the code is compiled from
+	// source instead.
+	CachedData []byte
+
+	// ProduceCachedData requests code cache data for the compiled code,
+	// available from the CachedData method of the Script. It is ignored if
+	// CachedData is given.
+	ProduceCachedData bool
+}
+
+// Compile compiles the given code inside of the Context without running it.
+// The returned Script must be manually released to avoid leaking references.
+func (ctx *Context) Compile(code, filename string) (*Script, error) {
+	return ctx.CompileWithOptions(code, filename, CompileOptions{})
+}
+
+// CompileWithOptions compiles the given code inside of the Context with the
+// given options, without running it. The returned Script must be manually
+// released to avoid leaking references.
+func (ctx *Context) CompileWithOptions(code, filename string, opts CompileOptions) (*Script, error) {
+	defer ctx.lock()()
+
+	if ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	c_code := C.CString(code)
+	c_filename := C.CString(filename)
+	defer C.free(unsafe.Pointer(c_filename))
+	defer C.free(unsafe.Pointer(c_code))
+
+	var c_cache *C.char
+	if len(opts.CachedData) > 0 {
+		c_cache = (*C.char)(unsafe.Pointer(&opts.CachedData[0]))
+	}
+	produce := C.int(0)
+	if opts.ProduceCachedData {
+		produce = 1
+	}
+
+	res := C.V8_Context_Compile(ctx.ptr, c_code, c_filename, c_cache, C.int(len(opts.CachedData)), produce)
+
+	if res.cache.ptr != nil {
+		defer C.free(unsafe.Pointer(res.cache.ptr))
+	}
+	err := decodeError(res.e, res.exc)
+	if res.oom != 0 {
+		return nil, ErrOutOfMemory
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Script{
+		ptr:      res.s_ptr,
+		ctx:      ctx,
+		rejected: res.cache_rejected != 0,
+	}
+	if res.cache.ptr != nil {
+		s.cachedData = C.GoBytes(unsafe.Pointer(res.cache.ptr), res.cache.len)
+	}
+	return s, nil
+}
+
+// Run runs the Script inside of its Context. Either the returned Value or
+// error will be present, never both. If returned, the given Value must be
+// manually released to avoid leaking references.
+func (s *Script) Run() (*Value, error) {
+	if s == nil || s.ptr == nil || s.ctx == nil {
+		return nil, ErrReleasedContext
+	}
+
+	defer s.ctx.lock()()
+
+	if s.ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	return s.ctx.exec(func() C.Result {
+		return C.V8_Script_Run(s.ctx.ptr, s.ptr)
+	})
+}
+
+// RunRelease calls Run, returning only the error (if present). If Run
+// returns a Value, it will be released.
+func (s *Script) RunRelease() error {
+	val, err := s.Run()
+	val.Release()
+	return err
+}
+
+// CachedData returns the code cache data produced when the Script was
+// compiled with ProduceCachedData, or nil if none was produced.
+func (s *Script) CachedData() []byte {
+	return s.cachedData
+}
+
+// CachedDataRejected reports whether the code cache data given when the
+// Script was compiled was rejected, in which case it was compiled from
+// source.
+func (s *Script) CachedDataRejected() bool {
+	return s.rejected
+}
+
+// Release releases the compiled script. It is safe to release a nil *Script.
+func (s *Script) Release() {
+	if s == nil || s.ctx == nil || s.ptr == nil {
+		return
+	}
+
+	defer s.ctx.lock()()
+
+	if s.ctx.ptr != nil {
+		C.V8_Script_Release(s.ctx.ptr, s.ptr)
+	}
+	s.ctx = nil
+	s.ptr = nil
+}
@@ -13,8 +13,8 @@ import (
 	"errors"
 	"fmt"
 	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	// These are just required to make sure the files get properly vendored by "go mod"
@@ -27,13 +27,38 @@ import (
 
 var once sync.Once
 
-var ErrReleasedContext = errors.New("released context")
+// nextID is the id of the most recently created Context.
+var nextID int32
+
+var (
+	ErrReleasedContext = errors.New("released context")
+	ErrTerminated      = errors.New("execution terminated")
+	ErrOutOfMemory     = errors.New("out of memory")
+)
 
 // Context is a v8::Context wrapped in it's own v8::Isolate. It must be
 // manually released to avoid leaking references.
 type Context struct {
 	ptr C.ContextPtr
+	id  int
 	mu  sync.Mutex
+
+	// owner is the id of the OS thread executing a script in the Context,
+	// if any. Functions bound with Bind run on this thread while mu is held,
+	// and may use the Context without acquiring mu again.
+	owner uintptr
+
+	// termMu guards the execution state below, which allows execution to be
+	// terminated from another goroutine while mu is held by Eval.
+	termMu      sync.Mutex
+	running     int
+	terminating bool
+
+	functions   []Function
+	functionsMu sync.RWMutex
+
+	loop   *EventLoop
+	loopMu sync.Mutex
 }
 
 // Value is a v8::Persistent<v8::Value> associated with a v8::Context. It
@@ -44,14 +69,66 @@ type Value struct {
 	ctx *Context
 }
 
+// HeapStatistics describes the memory usage of the v8::Isolate wrapping a
+// Context. All sizes are in bytes.
+type HeapStatistics struct {
+	TotalHeapSize           uint64
+	TotalHeapSizeExecutable uint64
+	TotalPhysicalSize       uint64
+	TotalAvailableSize      uint64
+	UsedHeapSize            uint64
+	HeapSizeLimit           uint64
+	MallocedMemory          uint64
+	PeakMallocedMemory      uint64
+
+	// ExternalMemory is the memory held outside of the heap by JavaScript
+	// objects, such as the contents of ArrayBuffers.
+	ExternalMemory uint64
+
+	// NumberOfNativeContexts is the number of native contexts in the
+	// isolate. V8 6.0 does not report it, but each isolate holds exactly one
+	// Context, so it is always 1.
+	NumberOfNativeContexts uint64
+}
+
+// ContextOptions configures a new Context.
+type ContextOptions struct {
+	// MaxHeapSize is the maximum size of the JavaScript heap in bytes. If a
+	// script grows the heap beyond it, execution is terminated and
+	// ErrOutOfMemory is returned, after which the Context refuses to run any
+	// further scripts and should be released. Zero means V8's default limits,
+	// which abort the entire process when exceeded.
+	MaxHeapSize uint64
+
+	// Snapshot is a startup snapshot from which the Context is created, so
+	// that it starts out with the state left by the script the snapshot was
+	// created with, without running it again.
+	Snapshot *Snapshot
+}
+
 // NewContext creates a new Context. It should be released after use.
 func NewContext() *Context {
+	return NewContextWithOptions(ContextOptions{})
+}
+
+// NewContextWithOptions creates a new Context with the given options. It
+// should be released after use.
+func NewContextWithOptions(opts ContextOptions) *Context {
 	once.Do(func() {
 		C.V8_Init()
 	})
 
+	var c_snapshot *C.char
+	var snapshotLen int
+	if opts.Snapshot != nil && len(opts.Snapshot.data) > 0 {
+		c_snapshot = (*C.char)(unsafe.Pointer(&opts.Snapshot.data[0]))
+		snapshotLen = len(opts.Snapshot.data)
+	}
+
+	id := int(atomic.AddInt32(&nextID, 1))
 	ctx := &Context{
-		ptr: C.V8_Context_New(),
+		ptr: C.V8_Context_New(C.size_t(opts.MaxHeapSize), C.int(id), c_snapshot, C.int(snapshotLen)),
+		id:  id,
 	}
 
 	runtime.SetFinalizer(ctx, func(ctx *Context) {
@@ -63,39 +140,144 @@ func NewContext() *Context {
 
 // Release releases the Context, including it's internal v8::Context and
 // v8::Isolate. Any Values with outstanding references will become unusable
-// and may cause a segmentation fault if tried to access.
+// and may cause a segmentation fault if tried to access. Release must not be
+// called from a function bound with Bind.
 func (ctx *Context) Release() {
 	ctx.mu.Lock()
 	defer ctx.mu.Unlock()
+	ctx.termMu.Lock()
+	defer ctx.termMu.Unlock()
 
 	if ctx.ptr != nil {
+		unregister(ctx)
 		C.V8_Context_Release(ctx.ptr)
 		ctx.ptr = nil
 	}
 }
 
-// Call calls the given function with the provided arguments. The arguments
-// will be JSON encoded and passed to Eval.
+// lock acquires the Context lock and returns a function which releases it.
+// If the calling goroutine is already executing a script in the Context, as
+// is the case for functions bound with Bind, the lock is already held and
+// the returned function does nothing.
+func (ctx *Context) lock() func() {
+	if owner := atomic.LoadUintptr(&ctx.owner); owner != 0 && owner == uintptr(C.V8_Thread_ID()) {
+		return func() {}
+	}
+	ctx.mu.Lock()
+	return ctx.mu.Unlock
+}
+
+// TerminateExecution forcefully terminates the script currently running in
+// the Context, causing it to return ErrTerminated. It is safe to call from
+// any goroutine, and does nothing if no script is running. The Context
+// remains usable afterwards.
+func (ctx *Context) TerminateExecution() {
+	ctx.termMu.Lock()
+	defer ctx.termMu.Unlock()
+
+	if ctx.running > 0 && !ctx.terminating && ctx.ptr != nil {
+		ctx.terminating = true
+		C.V8_Context_Terminate(ctx.ptr)
+	}
+}
+
+// HeapStatistics returns the current heap statistics of the Context.
+func (ctx *Context) HeapStatistics() (HeapStatistics, error) {
+	defer ctx.lock()()
+
+	if ctx.ptr == nil {
+		return HeapStatistics{}, ErrReleasedContext
+	}
+
+	hs := C.V8_Context_HeapStatistics(ctx.ptr)
+	return HeapStatistics{
+		TotalHeapSize:           uint64(hs.total_heap_size),
+		TotalHeapSizeExecutable: uint64(hs.total_heap_size_executable),
+		TotalPhysicalSize:       uint64(hs.total_physical_size),
+		TotalAvailableSize:      uint64(hs.total_available_size),
+		UsedHeapSize:            uint64(hs.used_heap_size),
+		HeapSizeLimit:           uint64(hs.heap_size_limit),
+		MallocedMemory:          uint64(hs.malloced_memory),
+		PeakMallocedMemory:      uint64(hs.peak_malloced_memory),
+		ExternalMemory:          uint64(hs.external_memory),
+		NumberOfNativeContexts:  1,
+	}, nil
+}
+
+// Call calls the function with the given name, which may be a dotted path
+// from a global variable such as "app.render", with the provided arguments.
+// Global variables include top-level const, let and class declarations.
+// Arguments which are *Values are passed as they are, and must belong to the
+// Context; any others are JSON encoded and parsed into JavaScript values. The
+// returned Value must be manually released to avoid leaking references.
 func (ctx *Context) Call(name string, vs ...interface{}) (*Value, error) {
-	args := make([]string, len(vs))
+	args, release, err := ctx.callArgs(vs)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	defer ctx.lock()()
+
+	if ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	return ctx.exec(func() C.Result {
+		return C.V8_Context_Call(ctx.ptr, c_name, argvPtr(args), C.int(len(args)))
+	})
+}
+
+// callArgs converts the arguments given to Call into Values of the Context,
+// returning pointers to them along with a function which releases any that
+// were created. It must be called without holding the Context lock.
+func (ctx *Context) callArgs(vs []interface{}) ([]C.ValuePtr, func(), error) {
+	var created []*Value
+	release := func() {
+		for _, val := range created {
+			val.Release()
+		}
+	}
+
+	args := make([]C.ValuePtr, len(vs))
 	for i, v := range vs {
-		buf, err := json.Marshal(v)
+		if val, ok := v.(*Value); ok {
+			if val == nil || val.ptr == nil || val.ctx != ctx {
+				release()
+				return nil, nil, fmt.Errorf("can't use argument %d: value belongs to a different context", i)
+			}
+			args[i] = val.ptr
+			continue
+		}
+		val, err := ctx.NewValue(v)
 		if err != nil {
-			return nil, fmt.Errorf("can't encode argument %d (%v): %s", i, v, err)
+			release()
+			return nil, nil, fmt.Errorf("can't encode argument %d (%v): %s", i, v, err)
 		}
-		args[i] = string(buf)
+		created = append(created, val)
+		args[i] = val.ptr
 	}
-	code := fmt.Sprintf("%s(%s)", name, strings.Join(args, ","))
-	val, err := ctx.Eval(code, "")
-	return val, err
+
+	return args, release, nil
+}
+
+// argvPtr returns a pointer to the first of the given arguments, suitable for
+// passing to C along with their count.
+func argvPtr(args []C.ValuePtr) *C.ValuePtr {
+	if len(args) == 0 {
+		return nil
+	}
+	return &args[0]
 }
 
 // Eval evaluates the given code inside of the Context. Either the
 // returned Value or error will be present, never both. If returned, the
 // given Value must be manually released to avoid leaking references.
 func (ctx *Context) Eval(code, filename string) (*Value, error) {
-	ctx.mu.Lock()
-	defer ctx.mu.Unlock()
+	defer ctx.lock()()
 
 	if ctx.ptr == nil {
 		return nil, fmt.Errorf("invalid context")
@@ -103,10 +285,33 @@ func (ctx *Context) Eval(code, filename string) (*Value, error) {
 
 	c_code := C.CString(code)
 	c_filename := C.CString(filename)
-	result := C.V8_Context_Eval(ctx.ptr, c_code, c_filename)
-	C.free(unsafe.Pointer(c_filename))
-	C.free(unsafe.Pointer(c_code))
-	return ctx.decodeResult(result)
+	defer C.free(unsafe.Pointer(c_filename))
+	defer C.free(unsafe.Pointer(c_code))
+
+	return ctx.exec(func() C.Result {
+		return C.V8_Context_Eval(ctx.ptr, c_code, c_filename)
+	})
+}
+
+// NewValue creates a Value from the given Go value, which is JSON encoded and
+// parsed by V8. The returned Value must be manually released to avoid
+// leaking references.
+func (ctx *Context) NewValue(v interface{}) (*Value, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	defer ctx.lock()()
+
+	if ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	c_json := C.CString(string(buf))
+	defer C.free(unsafe.Pointer(c_json))
+
+	return ctx.decodeResult(C.V8_Context_ParseJSON(ctx.ptr, c_json, C.int(len(buf))))
 }
 
 // EvalRelease calls Eval, returning only the error (if present). If Eval
@@ -117,6 +322,65 @@ func (ctx *Context) EvalRelease(code, filename string) error {
 	return err
 }
 
+// exec runs fn, which must call into the Context, while tracking execution
+// state so that it may be terminated by TerminateExecution. If execution
+// was terminated, any result is discarded and ErrTerminated is returned, or
+// ErrOutOfMemory if it was terminated for exceeding the heap limit. Calls
+// to exec may be nested by functions bound with Bind. Once the outermost
+// call succeeds, pending microtasks such as promise reactions are run. The
+// caller must hold the Context lock.
+func (ctx *Context) exec(fn func() C.Result) (*Value, error) {
+	// Bound functions are called on the thread executing the script, which
+	// identifies them as holding the Context lock.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	owner := atomic.SwapUintptr(&ctx.owner, uintptr(C.V8_Thread_ID()))
+	defer atomic.StoreUintptr(&ctx.owner, owner)
+
+	ctx.termMu.Lock()
+	ctx.running++
+	first := ctx.running == 1
+	ctx.termMu.Unlock()
+
+	result := fn()
+	if first && result.v_ptr != nil {
+		mres := C.V8_Context_RunMicrotasks(ctx.ptr)
+		if mres.v_ptr != nil {
+			C.V8_Value_Release(ctx.ptr, mres.v_ptr)
+		}
+		decodeError(mres.e, mres.exc)
+		result.oom |= mres.oom
+		result.terminated |= mres.terminated
+	}
+
+	ctx.termMu.Lock()
+	ctx.running--
+	outermost := ctx.running == 0
+	requested := outermost && ctx.terminating
+	if outermost {
+		ctx.terminating = false
+	}
+	ctx.termMu.Unlock()
+
+	val, err := ctx.decodeResult(result)
+	terminated := result.terminated != 0 || requested
+	if outermost && (terminated || result.oom != 0) {
+		// Termination is only cancelled once the outermost script has
+		// unwound. A termination requested just as the script finished is
+		// still pending inside the isolate, so clear it before the next call.
+		C.V8_Context_CancelTerminate(ctx.ptr)
+	}
+	if result.oom != 0 {
+		val.releaseLocked()
+		return nil, ErrOutOfMemory
+	}
+	if terminated {
+		val.releaseLocked()
+		return nil, ErrTerminated
+	}
+	return val, err
+}
+
 // decodeResult turns a Result, which contains a Value or error, into
 // the appropriate go *Value and error types. If a Value is returned,
 // it must be manually released to avoid leaking references.
@@ -127,13 +391,7 @@ func (ctx *Context) decodeResult(res C.Result) (v *Value, err error) {
 			ptr: res.v_ptr,
 		}
 	}
-	if res.e.ptr != nil {
-		s := C.GoStringN(res.e.ptr, res.e.len)
-		C.free(unsafe.Pointer(res.e.ptr))
-
-		sc := string([]byte(s))
-		err = errors.New(sc)
-	}
+	err = decodeError(res.e, res.exc)
 	return
 }
 
@@ -145,12 +403,17 @@ func (val *Value) String() string {
 		return "undefined"
 	}
 
-	val.ctx.mu.Lock()
-	defer val.ctx.mu.Unlock()
+	defer val.ctx.lock()()
 	if val.ctx.ptr == nil {
 		return "undefined"
 	}
 
+	return val.stringLocked()
+}
+
+// stringLocked returns the string value of the Value. The caller must hold
+// the Context lock.
+func (val *Value) stringLocked() string {
 	c_s := C.V8_Value_String(val.ctx.ptr, val.ptr)
 	s := C.GoStringN(c_s.ptr, c_s.len)
 	C.free(unsafe.Pointer(c_s.ptr))
@@ -167,8 +430,16 @@ func (val *Value) Release() {
 		return
 	}
 
-	val.ctx.mu.Lock()
-	defer val.ctx.mu.Unlock()
+	defer val.ctx.lock()()
+
+	val.releaseLocked()
+}
+
+// releaseLocked releases the Value. The caller must hold the Context lock.
+func (val *Value) releaseLocked() {
+	if val == nil || val.ctx == nil || val.ptr == nil {
+		return
+	}
 
 	if val.ctx.ptr != nil {
 		C.V8_Value_Release(val.ctx.ptr, val.ptr)
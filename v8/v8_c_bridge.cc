@@ -5,8 +5,10 @@
 
 #include <cstdlib>
 #include <cstring>
+#include <limits>
 #include <string>
-#include <sstream>
+#include <vector>
+#include <pthread.h>
 #include <stdio.h>
 
 #define ISOLATE_SCOPE(isolate_ptr) \
@@ -27,9 +29,14 @@
 typedef struct {
   v8::Persistent<v8::Context> ptr;
   v8::Isolate* isolate;
+  int id;
+  size_t max_heap_size;
+  bool out_of_memory;
+  v8::StartupData snapshot;
 } Context;
 
 typedef v8::Persistent<v8::Value> V8_Persistent_Value;
+typedef v8::Persistent<v8::UnboundScript> V8_Persistent_Script;
 
 String DupString(const v8::String::Utf8Value& src) {
   char* data = static_cast<char*>(malloc(src.length()));
@@ -57,37 +64,152 @@ std::string str(v8::Local<v8::Value> value) {
   return *s;
 }
 
-std::string report_exception(v8::Isolate* isolate, v8::TryCatch& try_catch) {
-  std::stringstream ss;
-  ss << "Uncaught exception: ";
-
-  std::string exceptionStr = str(try_catch.Exception());
-  ss << exceptionStr; // TODO(aroman) JSON-ify objects?
-
-  if (!try_catch.Message().IsEmpty()) {
-    if (!try_catch.Message()->GetScriptResourceName()->IsUndefined()) {
-      ss << std::endl
-         << "at " << str(try_catch.Message()->GetScriptResourceName()) << ":"
-         << try_catch.Message()->GetLineNumber() << ":"
-         << try_catch.Message()->GetStartColumn() << std::endl
-         << "  " << str(try_catch.Message()->GetSourceLine()) << std::endl
-         << "  ";
-      int start = try_catch.Message()->GetStartColumn();
-      int end = try_catch.Message()->GetEndColumn();
-      for (int i = 0; i < start; i++) {
-        ss << " ";
-      }
-      for (int i = start; i < end; i++) {
-        ss << "^";
-      }
+// describe_exception creates an Exception describing the given exception,
+// along with the message and stack trace it was reported with, which may be
+// empty. The Exception and its strings are owned by the caller.
+Exception* describe_exception(v8::Isolate* isolate, v8::Local<v8::Value> exception, v8::Local<v8::Message> message, v8::Local<v8::Value> stack) {
+  Exception* exc = static_cast<Exception*>(calloc(1, sizeof(Exception)));
+  exc->text = DupString(str(exception));
+
+  if (exception->IsObject()) {
+    // Reading the properties may run getters, which must not disturb the
+    // exception being reported.
+    v8::TryCatch try_catch;
+    try_catch.SetVerbose(false);
+    v8::Local<v8::Context> local_context = isolate->GetCurrentContext();
+    v8::Local<v8::Object> obj = v8::Local<v8::Object>::Cast(exception);
+    v8::Local<v8::Value> value;
+    if (obj->Get(local_context, v8::String::NewFromUtf8(isolate, "name")).ToLocal(&value) && value->IsString()) {
+      exc->name = DupString(str(value));
+    }
+    if (obj->Get(local_context, v8::String::NewFromUtf8(isolate, "message")).ToLocal(&value) && value->IsString()) {
+      exc->message = DupString(str(value));
     }
+  } else {
+    exc->message = DupString(str(exception));
+  }
+
+  if (!message.IsEmpty() && !message->GetScriptResourceName()->IsUndefined()) {
+    exc->has_location = 1;
+    exc->script_name = DupString(str(message->GetScriptResourceName()));
+    exc->line = message->GetLineNumber();
+    exc->start_column = message->GetStartColumn();
+    exc->end_column = message->GetEndColumn();
+    exc->source_line = DupString(str(message->GetSourceLine()));
   }
 
-  if (!try_catch.StackTrace().IsEmpty()) {
-    ss << std::endl << "Stack trace: " << str(try_catch.StackTrace());
+  if (!stack.IsEmpty()) {
+    exc->has_stack = 1;
+    exc->stack_is_string = stack->IsString() ? 1 : 0;
+    exc->stack = DupString(str(stack));
   }
 
-  return ss.str();
+  return exc;
+}
+
+// new_exception creates an Exception describing the exception caught by
+// try_catch.
+Exception* new_exception(v8::Isolate* isolate, v8::TryCatch& try_catch) {
+  return describe_exception(isolate, try_catch.Exception(), try_catch.Message(), try_catch.StackTrace());
+}
+
+// rejection_stack returns the stack of an Error a promise was rejected with,
+// or an empty handle if it has none.
+v8::Local<v8::Value> rejection_stack(v8::Isolate* isolate, v8::Local<v8::Context> local_context, v8::Local<v8::Value> reason) {
+  if (reason->IsObject()) {
+    v8::TryCatch try_catch;
+    try_catch.SetVerbose(false);
+    v8::Local<v8::Object> obj = v8::Local<v8::Object>::Cast(reason);
+    v8::Local<v8::Value> stack;
+    if (obj->Get(local_context, v8::String::NewFromUtf8(isolate, "stack")).ToLocal(&stack) && stack->IsString()) {
+      return stack;
+    }
+  }
+  return v8::Local<v8::Value>();
+}
+
+// gc_epilogue is called by V8 after each garbage collection. If the heap is
+// still larger than the context allows, execution is terminated before V8
+// reaches its own hard limit and aborts the process.
+void gc_epilogue(v8::Isolate* isolate, v8::GCType type, v8::GCCallbackFlags flags) {
+  Context* context = static_cast<Context*>(isolate->GetData(0));
+  if (context->out_of_memory) {
+    return;
+  }
+
+  v8::HeapStatistics stats;
+  isolate->GetHeapStatistics(&stats);
+  if (stats.used_heap_size() > context->max_heap_size) {
+    context->out_of_memory = true;
+    isolate->TerminateExecution();
+  }
+}
+
+// callback_handler is the v8::FunctionCallback of every function bound from
+// Go. The callback id is stored in the function's data, and is handed to Go
+// along with the arguments, which Go is responsible for releasing. Go hands
+// over ownership of the value it returns, which is released here once it has
+// been set as the return value.
+void callback_handler(const v8::FunctionCallbackInfo<v8::Value>& info) {
+  v8::Isolate* isolate = info.GetIsolate();
+  Context* context = static_cast<Context*>(isolate->GetData(0));
+  int callback_id = v8::Local<v8::Integer>::Cast(info.Data())->Value();
+
+  int argc = info.Length();
+  ValuePtr* argv = new ValuePtr[argc > 0 ? argc : 1];
+  for (int i = 0; i < argc; i++) {
+    argv[i] = static_cast<ValuePtr>(new V8_Persistent_Value(isolate, info[i]));
+  }
+
+  Result res = goCallback(context->id, callback_id, argv, argc);
+  delete[] argv;
+
+  if (res.e.ptr != nullptr) {
+    if (!isolate->IsExecutionTerminating()) {
+      isolate->ThrowException(v8::Exception::Error(
+          v8::String::NewFromUtf8(isolate, res.e.ptr, v8::NewStringType::kNormal, res.e.len).ToLocalChecked()));
+    }
+    free((void*)res.e.ptr);
+    return;
+  }
+
+  if (res.v_ptr != nullptr) {
+    V8_Persistent_Value* ret = static_cast<V8_Persistent_Value*>(res.v_ptr);
+    info.GetReturnValue().Set(ret->Get(isolate));
+    ret->Reset();
+    delete ret;
+  }
+}
+
+// new_function creates a function which calls the Go function with the given
+// callback id.
+v8::MaybeLocal<v8::Function> new_function(v8::Isolate* isolate, v8::Local<v8::Context> local_context, int callback_id) {
+  v8::Local<v8::FunctionTemplate> tmpl = v8::FunctionTemplate::New(
+      isolate, callback_handler, v8::Integer::New(isolate, callback_id));
+  return tmpl->GetFunction(local_context);
+}
+
+// make_result creates a Result from the outcome of running a script, which
+// is either the value it produced or the reason it failed.
+Result make_result(Context* context, v8::TryCatch& try_catch, v8::MaybeLocal<v8::Value> maybe) {
+  v8::Isolate* isolate = context->isolate;
+  Result res = { nullptr, { nullptr, 0 }, 0, 0, nullptr };
+
+  v8::Local<v8::Value> result;
+  if (context->out_of_memory) {
+    res.e = DupString("out of memory");
+    res.oom = 1;
+  } else if (try_catch.HasTerminated()) {
+    res.e = DupString("execution terminated");
+    res.terminated = 1;
+  } else if (!maybe.ToLocal(&result)) {
+    res.exc = new_exception(isolate, try_catch);
+  } else {
+    V8_Persistent_Value* val = new V8_Persistent_Value(isolate, result);
+    res.v_ptr = static_cast<ValuePtr>(val);
+  }
+
+  return res;
 }
 
 // Called from Go
@@ -96,6 +218,10 @@ extern "C" {
 
 Version version = {V8_MAJOR_VERSION, V8_MINOR_VERSION, V8_BUILD_NUMBER, V8_PATCH_LEVEL};
 
+uintptr_t V8_Thread_ID() {
+  return (uintptr_t)pthread_self();
+}
+
 void V8_Init() {
   v8::Platform *platform = v8::platform::CreateDefaultPlatform();
   v8::V8::InitializePlatform(platform);
@@ -103,25 +229,96 @@ void V8_Init() {
   return;
 }
 
-ContextPtr V8_Context_New() {
+ContextPtr V8_Context_New(size_t max_heap_size, int id, const char* snapshot, int snapshot_len) {
+  Context* context = new Context;
+  context->snapshot = { nullptr, 0 };
+
   // Create a v8::Isolate
   v8::Isolate::CreateParams create_params;
   create_params.array_buffer_allocator = v8::ArrayBuffer::Allocator::NewDefaultAllocator();
+  if (snapshot_len > 0) {
+    // The isolate refers to the snapshot for as long as it lives, so it is
+    // copied and released along with the context.
+    char* data = new char[snapshot_len];
+    memcpy(data, snapshot, snapshot_len);
+    context->snapshot = { data, snapshot_len };
+    create_params.snapshot_blob = &context->snapshot;
+  }
+  if (max_heap_size > 0) {
+    // Leave V8 plenty of headroom above the limit enforced by gc_epilogue, as
+    // exceeding its own limit is fatal to the whole process.
+    int limit_in_mb = int(max_heap_size / (1024 * 1024)) * 2;
+    create_params.constraints.set_max_old_space_size(limit_in_mb < 16 ? 16 : limit_in_mb);
+  }
   v8::Isolate* isolate = v8::Isolate::New(create_params);
   v8::Locker locker(isolate);
   v8::Isolate::Scope isolate_scope(isolate);
   v8::HandleScope handle_scope(isolate);
 
+  // Microtasks, such as promise reactions, are run by V8_Context_RunMicrotasks
+  // once the outermost call into the context returns.
+  isolate->SetMicrotasksPolicy(v8::MicrotasksPolicy::kExplicit);
+
   v8::V8::SetCaptureStackTraceForUncaughtExceptions(true);
 
   v8::Local<v8::ObjectTemplate> globals = v8::ObjectTemplate::New(isolate);
 
-  Context* context = new Context;
   context->ptr.Reset(isolate, v8::Context::New(isolate, nullptr, globals));
   context->isolate = isolate;
+  context->id = id;
+  context->max_heap_size = max_heap_size;
+  context->out_of_memory = false;
+
+  isolate->SetData(0, context);
+  if (max_heap_size > 0) {
+    isolate->AddGCEpilogueCallback(gc_epilogue);
+  }
+
   return static_cast<ContextPtr>(context);
 }
 
+// V8_Snapshot_Create runs the given code in a new context and serializes the
+// resulting heap into a startup snapshot, from which contexts may be created
+// with V8_Context_New.
+SnapshotResult V8_Snapshot_Create(const char* code, const char* filename) {
+  SnapshotResult res = { { nullptr, 0 }, { nullptr, 0 }, nullptr };
+
+  v8::SnapshotCreator creator;
+  v8::Isolate* isolate = creator.GetIsolate();
+  isolate->SetCaptureStackTraceForUncaughtExceptions(true);
+  {
+    v8::HandleScope handle_scope(isolate);
+    v8::Local<v8::Context> local_context = v8::Context::New(isolate);
+    v8::Context::Scope context_scope(local_context);
+
+    v8::TryCatch try_catch;
+    try_catch.SetVerbose(false);
+
+    v8::ScriptOrigin origin(v8::String::NewFromUtf8(isolate, filename));
+    v8::Local<v8::Script> script;
+    if (!v8::Script::Compile(local_context, v8::String::NewFromUtf8(isolate, code), &origin).ToLocal(&script) ||
+        script->Run(local_context).IsEmpty()) {
+      res.exc = new_exception(isolate, try_catch);
+      return res;
+    }
+
+    creator.SetDefaultContext(local_context);
+  }
+
+  v8::StartupData blob = creator.CreateBlob(v8::SnapshotCreator::FunctionCodeHandling::kClear);
+  if (blob.data == nullptr || blob.raw_size == 0) {
+    res.e = DupString("unable to create snapshot");
+    return res;
+  }
+
+  char* data = static_cast<char*>(malloc(blob.raw_size));
+  memcpy(data, blob.data, blob.raw_size);
+  res.blob = (String){data, blob.raw_size};
+  delete[] blob.data;
+
+  return res;
+}
+
 // releaseIsolate retrieves the V8_Context and sets ISOLATE_SCOPE, then
 // resets the v8::Context and returns the v8::Isolate it used to contain.
 v8::Isolate* releaseIsolate(ContextPtr context_ptr) {
@@ -137,6 +334,44 @@ void V8_Context_Release(ContextPtr context_ptr) {
   v8::Isolate* isolate = releaseIsolate(context_ptr);
   // Dispose of the isolate
   isolate->Dispose();
+  Context* context = static_cast<Context*>(context_ptr);
+  delete[] context->snapshot.data;
+  delete context;
+}
+
+// V8_Context_Terminate terminates any script running inside the context. It
+// may be called from any thread, so it deliberately does not lock the isolate.
+void V8_Context_Terminate(ContextPtr context_ptr) {
+  Context* context = static_cast<Context*>(context_ptr);
+  context->isolate->TerminateExecution();
+}
+
+// V8_Context_CancelTerminate clears a pending termination so the context can
+// continue to be used.
+void V8_Context_CancelTerminate(ContextPtr context_ptr) {
+  CONTEXT_SCOPE(context_ptr);
+  isolate->CancelTerminateExecution();
+}
+
+// V8_Context_HeapStatistics returns the heap statistics of the context's
+// isolate, along with the external memory reported to it.
+HeapStatistics V8_Context_HeapStatistics(ContextPtr context_ptr) {
+  CONTEXT_SCOPE(context_ptr);
+
+  v8::HeapStatistics stats;
+  isolate->GetHeapStatistics(&stats);
+
+  return (HeapStatistics){
+    stats.total_heap_size(),
+    stats.total_heap_size_executable(),
+    stats.total_physical_size(),
+    stats.total_available_size(),
+    stats.used_heap_size(),
+    stats.heap_size_limit(),
+    stats.malloced_memory(),
+    stats.peak_malloced_memory(),
+    size_t(isolate->AdjustAmountOfExternalAllocatedMemory(0)),
+  };
 }
 
 // V8_Context_Eval compiles and run the given code inside of the context.
@@ -146,26 +381,292 @@ Result V8_Context_Eval(ContextPtr context_ptr, const char* code, const char* fil
   v8::TryCatch try_catch;
   try_catch.SetVerbose(false);
 
-  Result res = { nullptr, nullptr };
+  Result res = { nullptr, { nullptr, 0 }, 0, 0, nullptr };
+
+  if (context->out_of_memory) {
+    res.e = DupString("out of memory");
+    res.oom = 1;
+    return res;
+  }
 
   v8::Local<v8::Script> script = v8::Script::Compile(
       v8::String::NewFromUtf8(isolate, code),
       v8::String::NewFromUtf8(isolate, filename));
 
   if (script.IsEmpty()) {
-    res.e = DupString(report_exception(isolate, try_catch));
+    res.exc = new_exception(isolate, try_catch);
     return res;
   }
 
-  v8::Local<v8::Value> result = script->Run();
+  return make_result(context, try_catch, script->Run(local_context));
+}
 
-  if (result.IsEmpty()) {
-    res.e = DupString(report_exception(isolate, try_catch));
-  } else {
-    V8_Persistent_Value* val = new V8_Persistent_Value(isolate, result);
-    res.v_ptr = static_cast<ValuePtr>(val);
+// V8_Context_Compile compiles the given code without running it. If cache is
+// given, it is consumed as code cache data in place of parsing and compiling
+// the code, unless V8 rejects it. Otherwise, if produce_cache is set, code
+// cache data is produced for the compiled script.
+CompileResult V8_Context_Compile(ContextPtr context_ptr, const char* code, const char* filename, const char* cache, int cache_len, int produce_cache) {
+  VALUE_SCOPE(context_ptr);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  CompileResult res = { nullptr, { nullptr, 0 }, 0, { nullptr, 0 }, 0, nullptr };
+
+  if (context->out_of_memory) {
+    res.e = DupString("out of memory");
+    res.oom = 1;
+    return res;
+  }
+
+  v8::ScriptCompiler::CompileOptions options = v8::ScriptCompiler::kNoCompileOptions;
+  v8::ScriptCompiler::CachedData* cached_data = nullptr;
+  if (cache_len > 0) {
+    // The source takes ownership of the cached data, but not of its buffer.
+    cached_data = new v8::ScriptCompiler::CachedData(
+        reinterpret_cast<const uint8_t*>(cache), cache_len);
+    options = v8::ScriptCompiler::kConsumeCodeCache;
+  } else if (produce_cache) {
+    options = v8::ScriptCompiler::kProduceCodeCache;
+  }
+
+  v8::ScriptOrigin origin(v8::String::NewFromUtf8(isolate, filename));
+  v8::ScriptCompiler::Source source(v8::String::NewFromUtf8(isolate, code), origin, cached_data);
+
+  v8::Local<v8::UnboundScript> script;
+  if (!v8::ScriptCompiler::CompileUnboundScript(isolate, &source, options).ToLocal(&script)) {
+    if (context->out_of_memory) {
+      res.e = DupString("out of memory");
+      res.oom = 1;
+    } else {
+      res.exc = new_exception(isolate, try_catch);
+    }
+    return res;
+  }
+
+  const v8::ScriptCompiler::CachedData* data = source.GetCachedData();
+  if (cache_len > 0) {
+    res.cache_rejected = data->rejected ? 1 : 0;
+  } else if (produce_cache && data != nullptr && data->length > 0) {
+    char* buf = static_cast<char*>(malloc(data->length));
+    memcpy(buf, data->data, data->length);
+    res.cache = (String){buf, data->length};
+  }
+
+  res.s_ptr = static_cast<ScriptPtr>(new V8_Persistent_Script(isolate, script));
+  return res;
+}
+
+// is_identifier reports whether name is a plain JavaScript identifier, which
+// can safely be resolved by running it as a script.
+bool is_identifier(const std::string& name) {
+  if (name.empty() || (name[0] >= '0' && name[0] <= '9')) {
+    return false;
+  }
+  for (char c : name) {
+    if (!((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '$')) {
+      return false;
+    }
+  }
+  return true;
+}
+
+// resolve_global resolves a name the way a script would. Top-level const, let
+// and class declarations are bindings of the script scope rather than
+// properties of the global object, so identifiers are resolved by running
+// them as a script. Other names are looked up on the global object.
+v8::MaybeLocal<v8::Value> resolve_global(v8::Isolate* isolate, v8::Local<v8::Context> local_context, const std::string& name) {
+  v8::Local<v8::String> key = v8::String::NewFromUtf8(isolate, name.c_str());
+
+  if (is_identifier(name)) {
+    v8::Local<v8::Script> script;
+    if (!v8::Script::Compile(local_context, key).ToLocal(&script)) {
+      return v8::MaybeLocal<v8::Value>();
+    }
+    return script->Run(local_context);
+  }
+
+  v8::Local<v8::Object> global = local_context->Global();
+  bool has;
+  if (!global->Has(local_context, key).To(&has)) {
+    return v8::MaybeLocal<v8::Value>();
+  }
+  if (!has) {
+    std::string msg = name + " is not defined";
+    isolate->ThrowException(v8::Exception::ReferenceError(v8::String::NewFromUtf8(isolate, msg.c_str())));
+    return v8::MaybeLocal<v8::Value>();
+  }
+  return global->Get(local_context, key);
+}
+
+// V8_Context_Call calls the function with the given name, which may be a
+// dotted path from a global binding, with the given arguments. The object
+// holding the function is used as the receiver, or the global object for a
+// function which is itself a global binding.
+Result V8_Context_Call(ContextPtr context_ptr, const char* name, ValuePtr* argv, int argc) {
+  VALUE_SCOPE(context_ptr);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  v8::MaybeLocal<v8::Value> none;
+  if (context->out_of_memory) {
+    return make_result(context, try_catch, none);
   }
 
+  v8::Local<v8::Value> recv = local_context->Global();
+  v8::Local<v8::Value> value = recv;
+  std::string path(name);
+  size_t start = 0;
+  while (start <= path.length()) {
+    size_t dot = path.find('.', start);
+    if (dot == std::string::npos) {
+      dot = path.length();
+    }
+    std::string part = path.substr(start, dot - start);
+
+    if (start == 0) {
+      if (!resolve_global(isolate, local_context, part).ToLocal(&value)) {
+        return make_result(context, try_catch, none);
+      }
+      start = dot + 1;
+      continue;
+    }
+
+    if (!value->IsObject()) {
+      std::string msg = "Cannot read property '" + part + "' of " + str(value);
+      isolate->ThrowException(v8::Exception::TypeError(v8::String::NewFromUtf8(isolate, msg.c_str())));
+      return make_result(context, try_catch, none);
+    }
+
+    v8::Local<v8::Object> obj = v8::Local<v8::Object>::Cast(value);
+    v8::Local<v8::String> key = v8::String::NewFromUtf8(isolate, part.c_str());
+    recv = value;
+    if (!obj->Get(local_context, key).ToLocal(&value)) {
+      return make_result(context, try_catch, none);
+    }
+    start = dot + 1;
+  }
+
+  if (!value->IsFunction()) {
+    std::string msg = path + " is not a function";
+    isolate->ThrowException(v8::Exception::TypeError(v8::String::NewFromUtf8(isolate, msg.c_str())));
+    return make_result(context, try_catch, none);
+  }
+
+  std::vector<v8::Local<v8::Value>> args(argc);
+  for (int i = 0; i < argc; i++) {
+    args[i] = static_cast<V8_Persistent_Value*>(argv[i])->Get(isolate);
+  }
+
+  v8::Local<v8::Function> fn = v8::Local<v8::Function>::Cast(value);
+  return make_result(context, try_catch, fn->Call(local_context, recv, argc, args.data()));
+}
+
+// set_property sets a property of an object, reporting whether it now holds
+// the given value. Assignments to frozen or non-extensible objects fail
+// silently outside strict mode, so the property is read back to check.
+bool set_property(v8::Local<v8::Context> local_context, v8::Local<v8::Object> obj, v8::Local<v8::String> key, v8::Local<v8::Value> value) {
+  v8::Local<v8::Value> current;
+  return obj->Set(local_context, key, value).FromMaybe(false) &&
+         obj->Get(local_context, key).ToLocal(&current) &&
+         current->StrictEquals(value);
+}
+
+// bind_error creates the Result of a failure to bind a function, which is
+// the exception caught while walking the path, if any, or the given message.
+Result bind_error(Context* context, v8::TryCatch& try_catch, const std::string& msg) {
+  if (try_catch.HasCaught() || try_catch.HasTerminated() || context->out_of_memory) {
+    return make_result(context, try_catch, v8::MaybeLocal<v8::Value>());
+  }
+  Result res = { nullptr, { nullptr, 0 }, 0, 0, nullptr };
+  res.e = DupString(msg);
+  return res;
+}
+
+// V8_Context_Bind binds a function calling the Go function with the given
+// callback id to a property of the global object. The name may be a dotted
+// path, in which case any missing intermediate objects are created.
+Result V8_Context_Bind(ContextPtr context_ptr, const char* name, int callback_id) {
+  VALUE_SCOPE(context_ptr);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  Result res = { nullptr, { nullptr, 0 }, 0, 0, nullptr };
+
+  v8::Local<v8::Function> fn;
+  if (!new_function(isolate, local_context, callback_id).ToLocal(&fn)) {
+    res.e = DupString("unable to create function");
+    return res;
+  }
+
+  v8::Local<v8::Object> obj = local_context->Global();
+  std::string path(name);
+  size_t start = 0;
+  size_t dot;
+  while ((dot = path.find('.', start)) != std::string::npos) {
+    std::string part = path.substr(start, dot - start);
+    v8::Local<v8::String> key = v8::String::NewFromUtf8(isolate, part.c_str());
+    v8::Local<v8::Value> next;
+    if (!obj->Get(local_context, key).ToLocal(&next)) {
+      return bind_error(context, try_catch, "unable to get " + path.substr(0, dot));
+    }
+    if (next->IsUndefined()) {
+      next = v8::Object::New(isolate);
+      if (!set_property(local_context, obj, key, next)) {
+        return bind_error(context, try_catch, "unable to set " + path.substr(0, dot));
+      }
+    } else if (!next->IsObject()) {
+      res.e = DupString(path.substr(0, dot) + " is not an object");
+      return res;
+    }
+    obj = v8::Local<v8::Object>::Cast(next);
+    start = dot + 1;
+  }
+
+  v8::Local<v8::String> key = v8::String::NewFromUtf8(isolate, path.substr(start).c_str());
+  if (!set_property(local_context, obj, key, fn)) {
+    return bind_error(context, try_catch, "unable to set " + path);
+  }
+
+  return res;
+}
+
+// V8_Context_NewFunction creates a function calling the Go function with the
+// given callback id.
+Result V8_Context_NewFunction(ContextPtr context_ptr, int callback_id) {
+  VALUE_SCOPE(context_ptr);
+
+  Result res = { nullptr, { nullptr, 0 }, 0, 0, nullptr };
+
+  v8::Local<v8::Function> fn;
+  if (!new_function(isolate, local_context, callback_id).ToLocal(&fn)) {
+    res.e = DupString("unable to create function");
+    return res;
+  }
+
+  res.v_ptr = static_cast<ValuePtr>(new V8_Persistent_Value(isolate, fn));
+  return res;
+}
+
+// V8_Context_ParseJSON parses the given JSON text into a value.
+Result V8_Context_ParseJSON(ContextPtr context_ptr, const char* json, int len) {
+  VALUE_SCOPE(context_ptr);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  Result res = { nullptr, { nullptr, 0 }, 0, 0, nullptr };
+
+  v8::Local<v8::String> str = v8::String::NewFromUtf8(isolate, json, v8::NewStringType::kNormal, len).ToLocalChecked();
+  v8::Local<v8::Value> result;
+  if (!v8::JSON::Parse(local_context, str).ToLocal(&result)) {
+    res.exc = new_exception(isolate, try_catch);
+    return res;
+  }
+
+  res.v_ptr = static_cast<ValuePtr>(new V8_Persistent_Value(isolate, result));
   return res;
 }
 
@@ -175,6 +676,166 @@ String V8_Value_String(ContextPtr context_ptr, ValuePtr value_ptr) {
   return DupString(value->ToString());
 }
 
+int V8_Value_Kind(ContextPtr context_ptr, ValuePtr value_ptr) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+
+  int kind = 0;
+  if (value->IsUndefined()) kind |= V8_KIND_UNDEFINED;
+  if (value->IsNull()) kind |= V8_KIND_NULL;
+  if (value->IsString()) kind |= V8_KIND_STRING;
+  if (value->IsNumber()) kind |= V8_KIND_NUMBER;
+  if (value->IsBoolean()) kind |= V8_KIND_BOOLEAN;
+  if (value->IsArray()) kind |= V8_KIND_ARRAY;
+  if (value->IsObject()) kind |= V8_KIND_OBJECT;
+  if (value->IsFunction()) kind |= V8_KIND_FUNCTION;
+  if (value->IsPromise()) kind |= V8_KIND_PROMISE;
+  return kind;
+}
+
+// V8_Value_Float64 returns the numeric value of a primitive, or NaN for an
+// object, whose conversion could run arbitrary code.
+double V8_Value_Float64(ContextPtr context_ptr, ValuePtr value_ptr) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+  if (value->IsObject()) {
+    return std::numeric_limits<double>::quiet_NaN();
+  }
+  return value->NumberValue(local_context).FromMaybe(std::numeric_limits<double>::quiet_NaN());
+}
+
+// V8_Value_Int64 returns the integer value of a primitive, or zero for an
+// object, whose conversion could run arbitrary code.
+int64_t V8_Value_Int64(ContextPtr context_ptr, ValuePtr value_ptr) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+  if (value->IsObject()) {
+    return 0;
+  }
+  return value->IntegerValue(local_context).FromMaybe(0);
+}
+
+int V8_Value_Bool(ContextPtr context_ptr, ValuePtr value_ptr) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+  return value->BooleanValue(local_context).FromMaybe(false) ? 1 : 0;
+}
+
+// V8_Value_Length returns the length of an array, or zero for other values.
+uint32_t V8_Value_Length(ContextPtr context_ptr, ValuePtr value_ptr) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+  if (!value->IsArray()) {
+    return 0;
+  }
+  return v8::Local<v8::Array>::Cast(value)->Length();
+}
+
+Result V8_Value_Get(ContextPtr context_ptr, ValuePtr value_ptr, const char* key) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  if (!value->IsObject()) {
+    Result res = { nullptr, DupString("value is not an object"), 0, 0, nullptr };
+    return res;
+  }
+
+  v8::Local<v8::Object> obj = v8::Local<v8::Object>::Cast(value);
+  return make_result(context, try_catch, obj->Get(local_context, v8::String::NewFromUtf8(isolate, key)));
+}
+
+Result V8_Value_Set(ContextPtr context_ptr, ValuePtr value_ptr, const char* key, ValuePtr new_value_ptr) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+  v8::Local<v8::Value> new_value = static_cast<V8_Persistent_Value*>(new_value_ptr)->Get(isolate);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  if (!value->IsObject()) {
+    Result res = { nullptr, DupString("value is not an object"), 0, 0, nullptr };
+    return res;
+  }
+
+  v8::Local<v8::Object> obj = v8::Local<v8::Object>::Cast(value);
+  v8::Maybe<bool> ok = obj->Set(local_context, v8::String::NewFromUtf8(isolate, key), new_value);
+  v8::MaybeLocal<v8::Value> result;
+  if (ok.IsJust()) {
+    result = v8::Undefined(isolate);
+  }
+  return make_result(context, try_catch, result);
+}
+
+Result V8_Value_Index(ContextPtr context_ptr, ValuePtr value_ptr, uint32_t index) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  if (!value->IsObject()) {
+    Result res = { nullptr, DupString("value is not an object"), 0, 0, nullptr };
+    return res;
+  }
+
+  v8::Local<v8::Object> obj = v8::Local<v8::Object>::Cast(value);
+  return make_result(context, try_catch, obj->Get(local_context, index));
+}
+
+// V8_Value_Keys returns an array of the names of the enumerable properties of
+// an object.
+Result V8_Value_Keys(ContextPtr context_ptr, ValuePtr value_ptr) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  if (!value->IsObject()) {
+    Result res = { nullptr, DupString("value is not an object"), 0, 0, nullptr };
+    return res;
+  }
+
+  v8::Local<v8::Object> obj = v8::Local<v8::Object>::Cast(value);
+  v8::MaybeLocal<v8::Array> keys = obj->GetOwnPropertyNames(local_context);
+  v8::MaybeLocal<v8::Value> result;
+  if (!keys.IsEmpty()) {
+    result = keys.ToLocalChecked();
+  }
+  return make_result(context, try_catch, result);
+}
+
+// V8_Value_Call calls a function value with the given arguments and
+// undefined as the receiver.
+Result V8_Value_Call(ContextPtr context_ptr, ValuePtr value_ptr, ValuePtr* argv, int argc) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  v8::MaybeLocal<v8::Value> none;
+  if (context->out_of_memory) {
+    return make_result(context, try_catch, none);
+  }
+
+  if (!value->IsFunction()) {
+    isolate->ThrowException(v8::Exception::TypeError(v8::String::NewFromUtf8(isolate, "value is not a function")));
+    return make_result(context, try_catch, none);
+  }
+
+  std::vector<v8::Local<v8::Value>> args(argc);
+  for (int i = 0; i < argc; i++) {
+    args[i] = static_cast<V8_Persistent_Value*>(argv[i])->Get(isolate);
+  }
+
+  v8::Local<v8::Function> fn = v8::Local<v8::Function>::Cast(value);
+  return make_result(context, try_catch, fn->Call(local_context, v8::Undefined(isolate), argc, args.data()));
+}
+
 void V8_Value_Release(ContextPtr context_ptr, ValuePtr value_ptr) {
   VALUE_SCOPE(context_ptr);
   V8_Persistent_Value* value = static_cast<V8_Persistent_Value*>(value_ptr);
@@ -182,4 +843,80 @@ void V8_Value_Release(ContextPtr context_ptr, ValuePtr value_ptr) {
   delete value;
 }
 
+// V8_Context_RunMicrotasks runs all pending microtasks.
+Result V8_Context_RunMicrotasks(ContextPtr context_ptr) {
+  VALUE_SCOPE(context_ptr);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  isolate->RunMicrotasks();
+
+  v8::MaybeLocal<v8::Value> result = v8::Undefined(isolate);
+  return make_result(context, try_catch, result);
+}
+
+int V8_Value_PromiseState(ContextPtr context_ptr, ValuePtr value_ptr) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+  if (!value->IsPromise()) {
+    return -1;
+  }
+  return v8::Local<v8::Promise>::Cast(value)->State();
+}
+
+// V8_Value_PromiseResult returns the value of a fulfilled promise, or an
+// error describing the reason a rejected promise was rejected.
+Result V8_Value_PromiseResult(ContextPtr context_ptr, ValuePtr value_ptr) {
+  VALUE_SCOPE(context_ptr);
+  v8::Local<v8::Value> value = static_cast<V8_Persistent_Value*>(value_ptr)->Get(isolate);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  Result res = { nullptr, { nullptr, 0 }, 0, 0, nullptr };
+
+  if (!value->IsPromise()) {
+    res.e = DupString("value is not a promise");
+    return res;
+  }
+
+  v8::Local<v8::Promise> promise = v8::Local<v8::Promise>::Cast(value);
+  switch (promise->State()) {
+  case v8::Promise::kPending:
+    res.e = DupString("promise is pending");
+    break;
+  case v8::Promise::kRejected:
+    res.exc = describe_exception(isolate, promise->Result(), v8::Local<v8::Message>(), rejection_stack(isolate, local_context, promise->Result()));
+    break;
+  case v8::Promise::kFulfilled:
+    res.v_ptr = static_cast<ValuePtr>(new V8_Persistent_Value(isolate, promise->Result()));
+    break;
+  }
+
+  return res;
+}
+
+Result V8_Script_Run(ContextPtr context_ptr, ScriptPtr script_ptr) {
+  VALUE_SCOPE(context_ptr);
+
+  v8::TryCatch try_catch;
+  try_catch.SetVerbose(false);
+
+  v8::MaybeLocal<v8::Value> none;
+  if (context->out_of_memory) {
+    return make_result(context, try_catch, none);
+  }
+
+  v8::Local<v8::UnboundScript> script = static_cast<V8_Persistent_Script*>(script_ptr)->Get(isolate);
+  return make_result(context, try_catch, script->BindToCurrentContext()->Run(local_context));
+}
+
+void V8_Script_Release(ContextPtr context_ptr, ScriptPtr script_ptr) {
+  VALUE_SCOPE(context_ptr);
+  V8_Persistent_Script* script = static_cast<V8_Persistent_Script*>(script_ptr);
+  script->Reset();
+  delete script;
+}
+
 } // extern "C"
@@ -1,6 +1,9 @@
 #ifndef V8_C_BRIDGE_H
 #define V8_C_BRIDGE_H
 
+#include <stddef.h>
+#include <stdint.h>
+
 #ifdef __cplusplus
 extern "C" {
 #endif
@@ -8,6 +11,7 @@ extern "C" {
 // Go pointer types
 typedef void* ContextPtr;
 typedef void* ValuePtr;
+typedef void* ScriptPtr;
 
 // Go accessible string type
 typedef struct {
@@ -18,22 +22,113 @@ typedef struct {
 // Go accessible error type
 typedef String Error;
 
+// Go accessible exception type, describing an exception thrown by a script.
+// A result with an exception has no error message.
+typedef struct {
+  String text;
+  String name;
+  String message;
+  int has_location;
+  String script_name;
+  int line;
+  int start_column;
+  int end_column;
+  String source_line;
+  int has_stack;
+  int stack_is_string;
+  String stack;
+} Exception;
+
 // Go accessible Result type
 typedef struct {
   ValuePtr v_ptr;
   Error e;
+  int oom;
+  int terminated;
+  Exception* exc;
 } Result;
 
+// Go accessible compilation result type
+typedef struct {
+  ScriptPtr s_ptr;
+  Error e;
+  int oom;
+  String cache;
+  int cache_rejected;
+  Exception* exc;
+} CompileResult;
+
+// Go accessible snapshot result type
+typedef struct {
+  String blob;
+  Error e;
+  Exception* exc;
+} SnapshotResult;
+
+// Go accessible heap statistics type
+typedef struct {
+  size_t total_heap_size;
+  size_t total_heap_size_executable;
+  size_t total_physical_size;
+  size_t total_available_size;
+  size_t used_heap_size;
+  size_t heap_size_limit;
+  size_t malloced_memory;
+  size_t peak_malloced_memory;
+  size_t external_memory;
+} HeapStatistics;
+
+// Kind bits returned by V8_Value_Kind
+enum {
+  V8_KIND_UNDEFINED = 1 << 0,
+  V8_KIND_NULL      = 1 << 1,
+  V8_KIND_STRING    = 1 << 2,
+  V8_KIND_NUMBER    = 1 << 3,
+  V8_KIND_BOOLEAN   = 1 << 4,
+  V8_KIND_ARRAY     = 1 << 5,
+  V8_KIND_OBJECT    = 1 << 6,
+  V8_KIND_FUNCTION  = 1 << 7,
+  V8_KIND_PROMISE   = 1 << 8,
+};
+
 typedef struct { int Major, Minor, Build, Patch; } Version;
 extern Version version;
 
+// Implemented in Go
+extern Result     goCallback(int context_id, int callback_id, ValuePtr* argv, int argc);
+
 // Go accessible functions
 extern void       V8_Init();
-extern ContextPtr V8_Context_New();
+extern uintptr_t  V8_Thread_ID();
+extern ContextPtr V8_Context_New(size_t max_heap_size, int id, const char* snapshot, int snapshot_len);
 extern void       V8_Context_Release(ContextPtr ptr);
+extern SnapshotResult V8_Snapshot_Create(const char* code, const char* filename);
+extern void       V8_Context_Terminate(ContextPtr ptr);
+extern void       V8_Context_CancelTerminate(ContextPtr ptr);
+extern HeapStatistics V8_Context_HeapStatistics(ContextPtr ptr);
 extern Result     V8_Context_Eval(ContextPtr ptr, const char* code, const char* filename);
+extern CompileResult V8_Context_Compile(ContextPtr ptr, const char* code, const char* filename, const char* cache, int cache_len, int produce_cache);
+extern Result     V8_Context_Call(ContextPtr ptr, const char* name, ValuePtr* argv, int argc);
+extern Result     V8_Context_Bind(ContextPtr ptr, const char* name, int callback_id);
+extern Result     V8_Context_NewFunction(ContextPtr ptr, int callback_id);
+extern Result     V8_Context_ParseJSON(ContextPtr ptr, const char* json, int len);
 extern String     V8_Value_String(ContextPtr context_ptr, ValuePtr value_ptr);
+extern int        V8_Value_Kind(ContextPtr context_ptr, ValuePtr value_ptr);
+extern double     V8_Value_Float64(ContextPtr context_ptr, ValuePtr value_ptr);
+extern int64_t    V8_Value_Int64(ContextPtr context_ptr, ValuePtr value_ptr);
+extern int        V8_Value_Bool(ContextPtr context_ptr, ValuePtr value_ptr);
+extern uint32_t   V8_Value_Length(ContextPtr context_ptr, ValuePtr value_ptr);
+extern Result     V8_Value_Get(ContextPtr context_ptr, ValuePtr value_ptr, const char* key);
+extern Result     V8_Value_Set(ContextPtr context_ptr, ValuePtr value_ptr, const char* key, ValuePtr new_value_ptr);
+extern Result     V8_Value_Index(ContextPtr context_ptr, ValuePtr value_ptr, uint32_t index);
+extern Result     V8_Value_Keys(ContextPtr context_ptr, ValuePtr value_ptr);
+extern Result     V8_Value_Call(ContextPtr context_ptr, ValuePtr value_ptr, ValuePtr* argv, int argc);
 extern void       V8_Value_Release(ContextPtr context_ptr, ValuePtr value_ptr);
+extern Result     V8_Context_RunMicrotasks(ContextPtr context_ptr);
+extern int        V8_Value_PromiseState(ContextPtr context_ptr, ValuePtr value_ptr);
+extern Result     V8_Value_PromiseResult(ContextPtr context_ptr, ValuePtr value_ptr);
+extern Result     V8_Script_Run(ContextPtr context_ptr, ScriptPtr script_ptr);
+extern void       V8_Script_Release(ContextPtr context_ptr, ScriptPtr script_ptr);
 
 #ifdef __cplusplus
 }
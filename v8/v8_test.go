@@ -1,13 +1,17 @@
 package v8
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestReleaseValueAfterContext(t *testing.T) {
@@ -105,6 +109,738 @@ func TestEvalInvalidScript(t *testing.T) {
 	})
 }
 
+func TestJSError(t *testing.T) {
+	code := "function render() {\n  throw new TypeError(\"bad props\");\n}\nrender();"
+
+	withContext(func(ctx *Context) {
+		_, err := ctx.Eval(code, "server.js")
+		assertNotNil(t, err)
+
+		var jsErr *JSError
+		if !errors.As(err, &jsErr) {
+			t.Fatalf("expected *JSError, got %T", err)
+		}
+		assertEquals(t, "TypeError", jsErr.Name)
+		assertEquals(t, "bad props", jsErr.Message)
+		assertEquals(t, "server.js", jsErr.ScriptName)
+		assertEquals(t, 2, jsErr.Line)
+		assertEquals(t, `  throw new TypeError("bad props");`, jsErr.SourceLine)
+		assertContains(t, jsErr.Stack, "TypeError: bad props")
+		assertContains(t, err.Error(), "Uncaught exception: TypeError: bad props\nat server.js:2:")
+		assertContains(t, err.Error(), "\nStack trace: TypeError: bad props\n    at render (server.js:2:")
+
+		if len(jsErr.StackFrames) != 2 {
+			t.Fatalf("expected 2 stack frames, got %+v", jsErr.StackFrames)
+		}
+		assertEquals(t, "render", jsErr.StackFrames[0].Function)
+		assertEquals(t, "server.js", jsErr.StackFrames[0].ScriptName)
+		assertEquals(t, 2, jsErr.StackFrames[0].Line)
+		assertEquals(t, StackFrame{ScriptName: "server.js", Line: 4, Column: 1}, jsErr.StackFrames[1])
+
+		// values other than errors have only a message
+		_, err = ctx.Eval(`throw "oops"`, "")
+		if !errors.As(err, &jsErr) {
+			t.Fatalf("expected *JSError, got %T", err)
+		}
+		assertEquals(t, "", jsErr.Name)
+		assertEquals(t, "oops", jsErr.Message)
+		assertContains(t, err.Error(), "Uncaught exception: oops")
+	})
+}
+
+func TestParseStack(t *testing.T) {
+	frames := parseStack(`Error: failed
+    at render (bundle.js:10:5)
+    at Array.map (native)
+    at bundle.js:1:1`)
+	assertEquals(t, []StackFrame{
+		{Function: "render", ScriptName: "bundle.js", Line: 10, Column: 5},
+		{Function: "Array.map", ScriptName: "native"},
+		{ScriptName: "bundle.js", Line: 1, Column: 1},
+	}, frames)
+}
+
+func TestTerminateExecution(t *testing.T) {
+	withContext(func(ctx *Context) {
+		timer := time.AfterFunc(50*time.Millisecond, ctx.TerminateExecution)
+		defer timer.Stop()
+
+		val, err := ctx.Eval("while (true) {}", "loop.js")
+		assertNil(t, val)
+		if err != ErrTerminated {
+			t.Fatalf("expected ErrTerminated, got %v", err)
+		}
+
+		// the context should remain usable after termination
+		val, err = ctx.Eval("5 + 5;", "")
+		assertNil(t, err)
+		if s := val.String(); s != "10" {
+			t.Errorf("unexpected result after termination: %s", s)
+		}
+		val.Release()
+	})
+}
+
+func TestTerminateExecutionIdle(t *testing.T) {
+	withContext(func(ctx *Context) {
+		ctx.TerminateExecution()
+
+		val, err := ctx.Eval("5 + 5;", "")
+		assertNil(t, err)
+		if s := val.String(); s != "10" {
+			t.Errorf("unexpected result: %s", s)
+		}
+		val.Release()
+	})
+}
+
+func TestOutOfMemory(t *testing.T) {
+	ctx := NewContextWithOptions(ContextOptions{MaxHeapSize: 32 * 1024 * 1024})
+	defer ctx.Release()
+
+	code := `var a = []; while (true) { a.push(new Array(10000).join("x") + a.length); }`
+	val, err := ctx.Eval(code, "oom.js")
+	assertNil(t, val)
+	if err != ErrOutOfMemory {
+		t.Fatalf("expected ErrOutOfMemory, got %v", err)
+	}
+
+	// the context refuses to run further scripts
+	val, err = ctx.Eval("5 + 5;", "")
+	assertNil(t, val)
+	if err != ErrOutOfMemory {
+		t.Fatalf("expected ErrOutOfMemory, got %v", err)
+	}
+}
+
+func TestHeapStatistics(t *testing.T) {
+	ctx := NewContext()
+
+	hs, err := ctx.HeapStatistics()
+	assertNil(t, err)
+	if hs.UsedHeapSize == 0 || hs.TotalHeapSize < hs.UsedHeapSize || hs.HeapSizeLimit == 0 {
+		t.Errorf("unexpected heap statistics: %+v", hs)
+	}
+	if hs.NumberOfNativeContexts != 1 {
+		t.Errorf("expected 1 native context, got %d", hs.NumberOfNativeContexts)
+	}
+
+	ctx.Release()
+	if _, err := ctx.HeapStatistics(); err != ErrReleasedContext {
+		t.Errorf("expected ErrReleasedContext, got %v", err)
+	}
+}
+
+func TestBind(t *testing.T) {
+	withContext(func(ctx *Context) {
+		err := ctx.Bind("assets.url", func(args []*Value) (*Value, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("expected 1 argument, got %d", len(args))
+			}
+			return ctx.NewValue("/static/" + args[0].String())
+		})
+		assertNil(t, err)
+
+		val, err := ctx.Eval(`assets.url("app.css")`, "")
+		assertNil(t, err)
+		if s := val.String(); s != "/static/app.css" {
+			t.Errorf("unexpected result: %s", s)
+		}
+		val.Release()
+
+		// errors are thrown as exceptions which may be caught
+		val, err = ctx.Eval(`try { assets.url(); } catch (e) { e.message }`, "")
+		assertNil(t, err)
+		if s := val.String(); s != "expected 1 argument, got 0" {
+			t.Errorf("unexpected result: %s", s)
+		}
+		val.Release()
+
+		// uncaught errors are returned from Eval
+		_, err = ctx.Eval(`assets.url()`, "")
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "Error: expected 1 argument, got 0")
+		}
+	})
+}
+
+func TestBindReleasesReturnValues(t *testing.T) {
+	withContext(func(ctx *Context) {
+		var returned []*Value
+		err := ctx.Bind("echo", func(args []*Value) (*Value, error) {
+			val, err := ctx.NewValue(args[0].String() + "!")
+			returned = append(returned, val)
+			return val, err
+		})
+		assertNil(t, err)
+		assertNil(t, ctx.Bind("same", func(args []*Value) (*Value, error) {
+			return args[0], nil
+		}))
+
+		val, err := ctx.Eval(`var out = ""; for (var i = 0; i < 100; i++) { out = echo(same("hi")); } out`, "")
+		assertNil(t, err)
+		if s := val.String(); s != "hi!" {
+			t.Errorf("unexpected result: %s", s)
+		}
+		val.Release()
+
+		// every value returned from Go has been released by the bridge
+		if len(returned) != 100 {
+			t.Fatalf("expected 100 calls, got %d", len(returned))
+		}
+		for _, v := range returned {
+			if v.ptr != nil {
+				t.Fatal("expected the returned value to be released")
+			}
+		}
+	})
+}
+
+func TestBindNestedEval(t *testing.T) {
+	withContext(func(ctx *Context) {
+		err := ctx.Bind("double", func(args []*Value) (*Value, error) {
+			return ctx.Eval(fmt.Sprintf("%s * 2", args[0].String()), "")
+		})
+		assertNil(t, err)
+
+		val, err := ctx.Eval(`double(21)`, "")
+		assertNil(t, err)
+		if s := val.String(); s != "42" {
+			t.Errorf("unexpected result: %s", s)
+		}
+		val.Release()
+	})
+}
+
+func TestBindPanic(t *testing.T) {
+	withContext(func(ctx *Context) {
+		err := ctx.Bind("explode", func(args []*Value) (*Value, error) {
+			panic("boom")
+		})
+		assertNil(t, err)
+
+		_, err = ctx.Eval(`explode()`, "")
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "panic: boom")
+		}
+	})
+}
+
+func TestBindNotObject(t *testing.T) {
+	withContext(func(ctx *Context) {
+		assertNil(t, ctx.EvalRelease(`var flags = 5;`, ""))
+		err := ctx.Bind("flags.enabled", func(args []*Value) (*Value, error) {
+			return nil, nil
+		})
+		assertNotNil(t, err)
+	})
+}
+
+func TestBindFailures(t *testing.T) {
+	withContext(func(ctx *Context) {
+		assertNil(t, ctx.EvalRelease(`
+			var app = {};
+			Object.defineProperty(app, "broken", { get: function() { throw new Error("no access"); } });
+			var frozen = Object.freeze({});
+		`, ""))
+		noop := func(args []*Value) (*Value, error) { return nil, nil }
+
+		err := ctx.Bind("app.broken.fn", noop)
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "no access")
+		}
+
+		err = ctx.Bind("frozen.fn", noop)
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "unable to set frozen.fn")
+		}
+
+		err = ctx.Bind("frozen.nested.fn", noop)
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "unable to set frozen.nested")
+		}
+
+		// the context is still usable
+		assertNil(t, ctx.Bind("app.fn", noop))
+		val, err := ctx.Eval(`typeof app.fn`, "")
+		assertNil(t, err)
+		assertEquals(t, "function", val.String())
+		val.Release()
+	})
+}
+
+func TestValueTypes(t *testing.T) {
+	withContext(func(ctx *Context) {
+		tests := []struct {
+			code  string
+			check func(*Value) bool
+		}{
+			{`undefined`, (*Value).IsUndefined},
+			{`null`, (*Value).IsNull},
+			{`"hello"`, (*Value).IsString},
+			{`3.5`, (*Value).IsNumber},
+			{`true`, (*Value).IsBoolean},
+			{`[1, 2]`, (*Value).IsArray},
+			{`({})`, (*Value).IsObject},
+			{`(function() {})`, (*Value).IsFunction},
+			{`Promise.resolve(1)`, (*Value).IsPromise},
+		}
+		for _, test := range tests {
+			val, err := ctx.Eval(test.code, "")
+			assertNil(t, err)
+			if !test.check(val) {
+				t.Errorf("unexpected type for %s", test.code)
+			}
+			val.Release()
+		}
+
+		val, err := ctx.Eval(`"hello"`, "")
+		assertNil(t, err)
+		assertEquals(t, false, val.IsNumber())
+		assertEquals(t, false, val.IsObject())
+		val.Release()
+
+		var nilValue *Value
+		assertEquals(t, true, nilValue.IsUndefined())
+	})
+}
+
+func TestValueScalars(t *testing.T) {
+	withContext(func(ctx *Context) {
+		val, err := ctx.Eval(`-42.75`, "")
+		assertNil(t, err)
+		assertEquals(t, -42.75, val.Float64())
+		assertEquals(t, int64(-42), val.Int64())
+		assertEquals(t, true, val.Bool())
+		val.Release()
+
+		val, err = ctx.Eval(`""`, "")
+		assertNil(t, err)
+		assertEquals(t, false, val.Bool())
+		val.Release()
+
+		// objects are never converted, since that could run arbitrary code
+		val, err = ctx.Eval(`({ valueOf: function() { throw new Error("called") } })`, "")
+		assertNil(t, err)
+		assertEquals(t, int64(0), val.Int64())
+		assertEquals(t, true, math.IsNaN(val.Float64()))
+		val.Release()
+	})
+}
+
+func TestValueProperties(t *testing.T) {
+	withContext(func(ctx *Context) {
+		obj, err := ctx.Eval(`({ name: "reactor", tags: ["a", "b", "c"] })`, "")
+		assertNil(t, err)
+		defer obj.Release()
+
+		name, err := obj.Get("name")
+		assertNil(t, err)
+		assertEquals(t, "reactor", name.String())
+		name.Release()
+
+		missing, err := obj.Get("missing")
+		assertNil(t, err)
+		assertEquals(t, true, missing.IsUndefined())
+		missing.Release()
+
+		tags, err := obj.Get("tags")
+		assertNil(t, err)
+		assertEquals(t, 3, tags.Length())
+		tag, err := tags.Index(1)
+		assertNil(t, err)
+		assertEquals(t, "b", tag.String())
+		tag.Release()
+		tags.Release()
+
+		version, err := ctx.NewValue(2)
+		assertNil(t, err)
+		assertNil(t, obj.Set("version", version))
+		version.Release()
+
+		keys, err := obj.Keys()
+		assertNil(t, err)
+		assertEquals(t, []string{"name", "tags", "version"}, keys)
+
+		str, err := ctx.Eval(`"hello"`, "")
+		assertNil(t, err)
+		_, err = str.Get("length")
+		assertEquals(t, ErrNotObject, err)
+		str.Release()
+
+		// exceptions thrown by getters are returned
+		obj, err = ctx.Eval(`({ get broken() { throw new Error("broken getter") } })`, "")
+		assertNil(t, err)
+		_, err = obj.Get("broken")
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "broken getter")
+		}
+		obj.Release()
+	})
+}
+
+func TestValueExport(t *testing.T) {
+	type Meta struct {
+		Title string `json:"title"`
+	}
+	type Page struct {
+		Meta
+		Name    string
+		Count   int            `json:"count"`
+		Ratio   float64        `json:"ratio"`
+		Enabled bool           `json:"enabled"`
+		Tags    []string       `json:"tags"`
+		Attrs   map[string]int `json:"attrs"`
+		Parent  *Page          `json:"parent"`
+		Ignored string         `json:"-"`
+		Any     interface{}    `json:"any"`
+	}
+
+	withContext(func(ctx *Context) {
+		val, err := ctx.Eval(`({
+			title: "Home",
+			name: "home",
+			count: 3,
+			ratio: 0.5,
+			enabled: true,
+			tags: ["a", "b"],
+			attrs: { x: 1, y: 2 },
+			parent: { name: "root", parent: null },
+			Ignored: "nope",
+			any: { list: [1, "two", false, null] },
+		})`, "")
+		assertNil(t, err)
+		defer val.Release()
+
+		var page Page
+		assertNil(t, val.Export(&page))
+		assertEquals(t, Page{
+			Meta:    Meta{Title: "Home"},
+			Name:    "home",
+			Count:   3,
+			Ratio:   0.5,
+			Enabled: true,
+			Tags:    []string{"a", "b"},
+			Attrs:   map[string]int{"x": 1, "y": 2},
+			Parent:  &Page{Name: "root"},
+			Any: map[string]interface{}{
+				"list": []interface{}{float64(1), "two", false, nil},
+			},
+		}, page)
+
+		var n int
+		err = val.Export(&n)
+		assertNotNil(t, err)
+		if err != nil {
+			assertEquals(t, "v8: cannot export object into Go value of type int", err.Error())
+		}
+
+		frac, err := ctx.Eval(`1.5`, "")
+		assertNil(t, err)
+		assertNotNil(t, frac.Export(&n))
+		frac.Release()
+
+		var small int8
+		big, err := ctx.Eval(`1000`, "")
+		assertNil(t, err)
+		assertNotNil(t, big.Export(&small))
+		big.Release()
+
+		assertNotNil(t, val.Export(page))
+	})
+}
+
+func TestValueExportCycle(t *testing.T) {
+	withContext(func(ctx *Context) {
+		val, err := ctx.Eval(`var a = {}; a.self = a; a`, "")
+		assertNil(t, err)
+		defer val.Release()
+
+		var v interface{}
+		err = val.Export(&v)
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "nested too deeply")
+		}
+	})
+}
+
+func TestCall(t *testing.T) {
+	withContext(func(ctx *Context) {
+		err := ctx.EvalRelease(`
+			var app = {
+				prefix: "Hello, ",
+				greet: function(who, opts) { return this.prefix + who + (opts.excited ? "!" : "."); },
+			};
+			var answer = 42;
+		`, "app.js")
+		assertNil(t, err)
+
+		val, err := ctx.Call("app.greet", "world", map[string]bool{"excited": true})
+		assertNil(t, err)
+		assertEquals(t, "Hello, world!", val.String())
+		val.Release()
+
+		// values are passed through as they are
+		who, err := ctx.Eval(`"values"`, "")
+		assertNil(t, err)
+		opts, err := ctx.Eval(`({ excited: false })`, "")
+		assertNil(t, err)
+		val, err = ctx.Call("app.greet", who, opts)
+		assertNil(t, err)
+		assertEquals(t, "Hello, values.", val.String())
+		val.Release()
+		who.Release()
+		opts.Release()
+
+		_, err = ctx.Call("missing")
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "ReferenceError: missing is not defined")
+		}
+
+		_, err = ctx.Call("answer")
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "TypeError: answer is not a function")
+		}
+
+		_, err = ctx.Call("app.missing.greet")
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "TypeError: Cannot read property 'greet' of undefined")
+		}
+
+		// the name is never evaluated as code
+		_, err = ctx.Call("app.greet('x', {}); answer")
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "is not a function")
+		}
+	})
+}
+
+func TestCallLexicalBindings(t *testing.T) {
+	withContext(func(ctx *Context) {
+		// top-level const, let and class declarations are not properties of
+		// the global object
+		err := ctx.EvalRelease(`
+			const render = function(n) { return n * 2; };
+			let app = { render: function(n) { return this.offset + n; }, offset: 1 };
+			class Renderer { static render(n) { return n + 10; } }
+		`, "app.js")
+		assertNil(t, err)
+
+		for name, want := range map[string]int64{"render": 4, "app.render": 3, "Renderer.render": 12} {
+			val, err := ctx.Call(name, 2)
+			if err != nil {
+				t.Fatalf("calling %s: %v", name, err)
+			}
+			if got := val.Int64(); got != want {
+				t.Errorf("expected %s to return %d, got %d", name, want, got)
+			}
+			val.Release()
+		}
+	})
+}
+
+func TestCompile(t *testing.T) {
+	withContext(func(ctx *Context) {
+		script, err := ctx.Compile(`var runs = (typeof runs === "undefined" ? 0 : runs) + 1; runs`, "runs.js")
+		assertNil(t, err)
+		defer script.Release()
+
+		for i := 1; i <= 3; i++ {
+			val, err := script.Run()
+			assertNil(t, err)
+			assertEquals(t, int64(i), val.Int64())
+			val.Release()
+		}
+
+		_, err = ctx.Compile(`var = ;`, "invalid.js")
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "SyntaxError")
+		}
+	})
+}
+
+func TestCompileCachedData(t *testing.T) {
+	code := `function double(x) { return x * 2 }; double(21)`
+
+	var data []byte
+	withContext(func(ctx *Context) {
+		script, err := ctx.CompileWithOptions(code, "double.js", CompileOptions{ProduceCachedData: true})
+		assertNil(t, err)
+		data = script.CachedData()
+		script.Release()
+	})
+	if len(data) == 0 {
+		t.Fatal("expected cached data to be produced")
+	}
+
+	withContext(func(ctx *Context) {
+		script, err := ctx.CompileWithOptions(code, "double.js", CompileOptions{CachedData: data})
+		assertNil(t, err)
+		defer script.Release()
+		assertEquals(t, false, script.CachedDataRejected())
+
+		val, err := script.Run()
+		assertNil(t, err)
+		assertEquals(t, "42", val.String())
+		val.Release()
+	})
+
+	// data for different code is rejected, and the code compiled from source
+	withContext(func(ctx *Context) {
+		script, err := ctx.CompileWithOptions(`"other"`, "other.js", CompileOptions{CachedData: data})
+		assertNil(t, err)
+		defer script.Release()
+		assertEquals(t, true, script.CachedDataRejected())
+
+		val, err := script.Run()
+		assertNil(t, err)
+		assertEquals(t, "other", val.String())
+		val.Release()
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	snapshot, err := CreateSnapshot(`
+		var greeting = ["Hello", "there"].join(" ");
+		function greet(who) { return greeting + ", " + who; }
+	`, "greet.js")
+	assertNil(t, err)
+	if snapshot == nil || len(snapshot.Bytes()) == 0 {
+		t.Fatal("expected snapshot data")
+	}
+
+	for i := 0; i < 2; i++ {
+		ctx := NewContextWithOptions(ContextOptions{Snapshot: NewSnapshot(snapshot.Bytes())})
+		val, err := ctx.Call("greet", "snapshot")
+		assertNil(t, err)
+		assertEquals(t, "Hello there, snapshot", val.String())
+		val.Release()
+		ctx.Release()
+	}
+
+	_, err = CreateSnapshot(`throw new Error("boom")`, "boom.js")
+	assertNotNil(t, err)
+	if err != nil {
+		assertContains(t, err.Error(), "Error: boom")
+	}
+}
+
+func TestPromise(t *testing.T) {
+	withContext(func(ctx *Context) {
+		// microtasks run once the call into the context returns
+		val, err := ctx.Eval(`Promise.resolve(20).then(function(x) { return x + 1; }).then(function(x) { return x * 2; })`, "")
+		assertNil(t, err)
+		assertEquals(t, PromiseFulfilled, val.PromiseState())
+		res, err := val.PromiseResult()
+		assertNil(t, err)
+		assertEquals(t, "42", res.String())
+		res.Release()
+		val.Release()
+
+		val, err = ctx.Eval(`Promise.reject(new TypeError("nope"))`, "")
+		assertNil(t, err)
+		assertEquals(t, PromiseRejected, val.PromiseState())
+		_, err = val.PromiseResult()
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "TypeError: nope")
+		}
+		val.Release()
+
+		// promises remain pending until settled by a later call
+		err = ctx.EvalRelease(`var resolve; var pending = new Promise(function(r) { resolve = r; });`, "")
+		assertNil(t, err)
+		val, err = ctx.Eval(`pending`, "")
+		assertNil(t, err)
+		defer val.Release()
+		assertEquals(t, PromisePending, val.PromiseState())
+		_, err = val.PromiseResult()
+		assertEquals(t, ErrPromisePending, err)
+
+		arg, err := ctx.NewValue("done")
+		assertNil(t, err)
+		res, err = ctx.Call("resolve", arg)
+		assertNil(t, err)
+		res.Release()
+		arg.Release()
+
+		assertEquals(t, PromiseFulfilled, val.PromiseState())
+		assertNil(t, ctx.RunMicrotasks())
+	})
+}
+
+func TestEventLoop(t *testing.T) {
+	withContext(func(ctx *Context) {
+		loop, err := ctx.EventLoop()
+		assertNil(t, err)
+
+		err = ctx.EvalRelease(`
+			var log = [];
+			setTimeout(function(x) { log.push("timeout " + x); }, 50, "a");
+			var cleared = setTimeout(function() { log.push("cleared"); }, 10);
+			clearTimeout(cleared);
+			setImmediate(function() { log.push("immediate"); });
+			var ticks = 0;
+			var interval = setInterval(function() {
+				log.push("tick");
+				if (++ticks === 3) {
+					clearInterval(interval);
+				}
+			}, 5);
+		`, "")
+		assertNil(t, err)
+		assertEquals(t, 3, loop.Len())
+
+		assertNil(t, loop.Run(context.Background(), nil))
+		assertEquals(t, 0, loop.Len())
+
+		val, err := ctx.Eval(`log.join(",")`, "")
+		assertNil(t, err)
+		assertEquals(t, "immediate,tick,tick,tick,timeout a", val.String())
+		val.Release()
+
+		// Run stops once done reports true
+		err = ctx.EvalRelease(`var resolved = false; setTimeout(function() { resolved = true; }, 5); setTimeout(function() {}, 10000);`, "")
+		assertNil(t, err)
+		err = loop.Run(context.Background(), func() bool {
+			val, _ := ctx.Eval(`resolved`, "")
+			defer val.Release()
+			return val.Bool()
+		})
+		assertNil(t, err)
+		assertEquals(t, 1, loop.Len())
+
+		// and when ctx is done
+		tctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assertEquals(t, context.DeadlineExceeded, loop.Run(tctx, nil))
+
+		assertNil(t, loop.Clear())
+		assertEquals(t, 0, loop.Len())
+
+		// exceptions thrown by timers are returned
+		err = ctx.EvalRelease(`setTimeout(function() { throw new Error("timer failed"); }, 0);`, "")
+		assertNil(t, err)
+		err = loop.Run(context.Background(), nil)
+		assertNotNil(t, err)
+		if err != nil {
+			assertContains(t, err.Error(), "timer failed")
+		}
+	})
+}
+
 func TestSegmentFault(t *testing.T) {
 	t.Skip("beware that a panic unrelated to v8 may cause the app to segfault")
 
@@ -0,0 +1,288 @@
+package v8
+
+// #include <stdlib.h>
+// #include "v8_c_bridge.h"
+import "C"
+
+import (
+	"errors"
+	"math"
+	"unsafe"
+)
+
+// ErrNotObject is returned when a property of a Value that is not an object
+// is accessed.
+var ErrNotObject = errors.New("value is not an object")
+
+// kind returns the V8_KIND_* bits describing the Value. A nil or released
+// Value is undefined.
+func (val *Value) kind() C.int {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return C.V8_KIND_UNDEFINED
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return C.V8_KIND_UNDEFINED
+	}
+
+	return val.kindLocked()
+}
+
+// kindLocked returns the V8_KIND_* bits describing the Value. The caller must
+// hold the Context lock.
+func (val *Value) kindLocked() C.int {
+	return C.V8_Value_Kind(val.ctx.ptr, val.ptr)
+}
+
+// IsUndefined reports whether the Value is undefined. A nil *Value is
+// undefined.
+func (val *Value) IsUndefined() bool { return val.kind()&C.V8_KIND_UNDEFINED != 0 }
+
+// IsNull reports whether the Value is null.
+func (val *Value) IsNull() bool { return val.kind()&C.V8_KIND_NULL != 0 }
+
+// IsString reports whether the Value is a string.
+func (val *Value) IsString() bool { return val.kind()&C.V8_KIND_STRING != 0 }
+
+// IsNumber reports whether the Value is a number.
+func (val *Value) IsNumber() bool { return val.kind()&C.V8_KIND_NUMBER != 0 }
+
+// IsBoolean reports whether the Value is a boolean.
+func (val *Value) IsBoolean() bool { return val.kind()&C.V8_KIND_BOOLEAN != 0 }
+
+// IsArray reports whether the Value is an array.
+func (val *Value) IsArray() bool { return val.kind()&C.V8_KIND_ARRAY != 0 }
+
+// IsObject reports whether the Value is an object. Arrays, functions and
+// promises are objects.
+func (val *Value) IsObject() bool { return val.kind()&C.V8_KIND_OBJECT != 0 }
+
+// IsFunction reports whether the Value is a function.
+func (val *Value) IsFunction() bool { return val.kind()&C.V8_KIND_FUNCTION != 0 }
+
+// IsPromise reports whether the Value is a promise.
+func (val *Value) IsPromise() bool { return val.kind()&C.V8_KIND_PROMISE != 0 }
+
+// Float64 returns the numeric value of the Value, as converted by Number().
+// Objects are not converted, since doing so may run arbitrary code, and
+// return NaN, as does a nil or released Value.
+func (val *Value) Float64() float64 {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return math.NaN()
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return math.NaN()
+	}
+
+	return float64(C.V8_Value_Float64(val.ctx.ptr, val.ptr))
+}
+
+// Int64 returns the integer value of the Value, truncating any fraction.
+// Objects, and a nil or released Value, return zero.
+func (val *Value) Int64() int64 {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return 0
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return 0
+	}
+
+	return int64(C.V8_Value_Int64(val.ctx.ptr, val.ptr))
+}
+
+// Bool returns the truthiness of the Value. A nil or released Value is
+// false.
+func (val *Value) Bool() bool {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return false
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return false
+	}
+
+	return C.V8_Value_Bool(val.ctx.ptr, val.ptr) != 0
+}
+
+// Length returns the length of an array, or zero if the Value is not an
+// array.
+func (val *Value) Length() int {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return 0
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return 0
+	}
+
+	return val.lengthLocked()
+}
+
+// lengthLocked returns the length of an array. The caller must hold the
+// Context lock.
+func (val *Value) lengthLocked() int {
+	return int(C.V8_Value_Length(val.ctx.ptr, val.ptr))
+}
+
+// Get returns the named property of an object. A missing property is
+// returned as undefined. The returned Value must be manually released to
+// avoid leaking references.
+func (val *Value) Get(key string) (*Value, error) {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return nil, ErrReleasedContext
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	return val.getLocked(key)
+}
+
+// getLocked returns the named property of an object. The caller must hold
+// the Context lock.
+func (val *Value) getLocked(key string) (*Value, error) {
+	if val.kindLocked()&C.V8_KIND_OBJECT == 0 {
+		return nil, ErrNotObject
+	}
+
+	c_key := C.CString(key)
+	defer C.free(unsafe.Pointer(c_key))
+
+	return val.ctx.exec(func() C.Result {
+		return C.V8_Value_Get(val.ctx.ptr, val.ptr, c_key)
+	})
+}
+
+// Set sets the named property of an object to v, which must belong to the
+// same Context.
+func (val *Value) Set(key string, v *Value) error {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return ErrReleasedContext
+	}
+	if v == nil || v.ptr == nil || v.ctx != val.ctx {
+		return errors.New("value belongs to a different context")
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return ErrReleasedContext
+	}
+	if val.kindLocked()&C.V8_KIND_OBJECT == 0 {
+		return ErrNotObject
+	}
+
+	c_key := C.CString(key)
+	defer C.free(unsafe.Pointer(c_key))
+
+	res, err := val.ctx.exec(func() C.Result {
+		return C.V8_Value_Set(val.ctx.ptr, val.ptr, c_key, v.ptr)
+	})
+	res.releaseLocked()
+	return err
+}
+
+// Index returns the element of an array (or any object) at index i. The
+// returned Value must be manually released to avoid leaking references.
+func (val *Value) Index(i int) (*Value, error) {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return nil, ErrReleasedContext
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	return val.indexLocked(i)
+}
+
+// indexLocked returns the element at index i. The caller must hold the
+// Context lock.
+func (val *Value) indexLocked(i int) (*Value, error) {
+	if i < 0 || i > math.MaxUint32 {
+		return nil, errors.New("index out of range")
+	}
+	if val.kindLocked()&C.V8_KIND_OBJECT == 0 {
+		return nil, ErrNotObject
+	}
+
+	return val.ctx.exec(func() C.Result {
+		return C.V8_Value_Index(val.ctx.ptr, val.ptr, C.uint32_t(i))
+	})
+}
+
+// Keys returns the names of the own enumerable properties of an object.
+func (val *Value) Keys() ([]string, error) {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return nil, ErrReleasedContext
+	}
+
+	defer val.ctx.lock()()
+	if val.ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	return val.keysLocked()
+}
+
+// keysLocked returns the names of the own enumerable properties of an
+// object. The caller must hold the Context lock.
+func (val *Value) keysLocked() ([]string, error) {
+	if val.kindLocked()&C.V8_KIND_OBJECT == 0 {
+		return nil, ErrNotObject
+	}
+
+	arr, err := val.ctx.exec(func() C.Result {
+		return C.V8_Value_Keys(val.ctx.ptr, val.ptr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer arr.releaseLocked()
+
+	keys := make([]string, arr.lengthLocked())
+	for i := range keys {
+		key, err := arr.indexLocked(i)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key.stringLocked()
+		key.releaseLocked()
+	}
+	return keys, nil
+}
+
+// Call calls a function Value with the provided arguments, which are
+// converted as by Context.Call, and undefined as the receiver. The returned
+// Value must be manually released to avoid leaking references.
+func (val *Value) Call(vs ...interface{}) (*Value, error) {
+	if val == nil || val.ptr == nil || val.ctx == nil {
+		return nil, ErrReleasedContext
+	}
+	ctx := val.ctx
+
+	args, release, err := ctx.callArgs(vs)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	defer ctx.lock()()
+
+	if ctx.ptr == nil {
+		return nil, ErrReleasedContext
+	}
+
+	return ctx.exec(func() C.Result {
+		return C.V8_Value_Call(ctx.ptr, val.ptr, argvPtr(args), C.int(len(args)))
+	})
+}
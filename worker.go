@@ -1,11 +1,15 @@
 package reactor
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jcoene/reactor/v8"
@@ -14,54 +18,366 @@ import (
 var (
 	ErrClosed   = errors.New("worker closed")
 	ErrTimedOut = errors.New("timed out")
+
+	// ErrOutOfMemory is returned when a script exceeds the MaxHeapSize of a
+	// worker. The worker is closed, as its runtime can no longer be trusted.
+	ErrOutOfMemory = v8.ErrOutOfMemory
+
+	// errAborted is returned internally by render when the render context
+	// is done before the script completes.
+	errAborted = errors.New("aborted")
 )
 
+// nextWorkerID is the id of the most recently created Worker.
+var nextWorkerID int64
+
+// entryFunction is the name of the global function in the server script that
+// is called to render a Request.
+const entryFunction = "render"
+
+// streamFunction is the name of the global function in the server script
+// that is called to render a Request as a stream, see RenderStream.
+const streamFunction = "renderStream"
+
+// serverScriptName is the script name the server script is compiled with,
+// which appears in the locations of JavaScript errors.
+const serverScriptName = "server.js"
+
 // Worker is a V8 runtime capable of rendering React components
 type Worker struct {
+	id      int64
 	version string
 	closed  bool
+	created time.Time
+
+	// renders is the number of renders performed, which is read by the pool
+	// without holding mu, so it is only accessed atomically.
+	renders int64
+
+	// idle is the time the worker was last returned to a Pool.
+	idle time.Time
+
+	ctx  *v8.Context
+	loop *v8.EventLoop
+	mu   sync.Mutex
+
+	// logger receives console output, tagged with the request being
+	// rendered, if any. When capture is set, the output of each render is
+	// also collected in captured for its Response.
+	logger   *slog.Logger
+	capture  bool
+	request  *Request
+	captured []ConsoleMessage
+
+	// sourceMap rewrites the locations of JavaScript errors, if set.
+	sourceMap *SourceMap
+
+	// componentErrors returns Response.Error as an error.
+	componentErrors bool
+
+	// stream receives the chunks passed to write by the server script during
+	// a streaming render. write is created for the first streaming render.
+	stream *streamWriter
+	write  *v8.Value
+
+	// heap holds the heap statistics as of the most recent render, so they
+	// can be read without waiting for a render in progress.
+	heap   v8.HeapStatistics
+	heapMu sync.Mutex
+}
+
+// WorkerOptions configures a new Worker.
+type WorkerOptions struct {
+	// MaxHeapSize is the maximum size of the JavaScript heap in bytes. A
+	// render that exceeds it fails with ErrOutOfMemory instead of aborting
+	// the process. Zero means V8's default limits.
+	MaxHeapSize uint64
+
+	// CachedData is V8 code cache data produced by compiling the same server
+	// code, which lets the worker skip parsing and compiling it. Data produced
+	// for different code, or by a different version of V8, is ignored.
+	CachedData []byte
+
+	// Snapshot is a startup snapshot created from the same server code, see
+	// v8.CreateSnapshot. If given, the worker is created from the snapshot
+	// instead of evaluating the code, and CachedData is unused.
+	Snapshot *v8.Snapshot
+
+	// EventLoop installs setTimeout, setInterval, setImmediate and their
+	// clear functions in the worker. When render returns a promise, timers
+	// run until it settles or the render times out. Timers still pending
+	// once the server code is loaded, or a render completes, are cancelled.
+	EventLoop bool
 
-	ctx *v8.Context
-	mu  sync.Mutex
+	// Logger receives lines written to the console by the server script,
+	// tagged with the worker id, code version and Request name. Nil means
+	// console output is discarded.
+	Logger *slog.Logger
+
+	// CaptureConsole collects the lines written to the console during each
+	// render in the Console field of its Response.
+	CaptureConsole bool
+
+	// SourceMap maps the server code back to its original source files. If
+	// given, the locations of JavaScript errors returned by the worker refer
+	// to those files instead of the server code.
+	SourceMap *SourceMap
+
+	// ComponentErrors returns an error reported by the server script in the
+	// Error field of a Response as a *RenderError of KindComponent, along
+	// with the Response. Otherwise such a Response is returned as a success.
+	ComponentErrors bool
+}
+
+// renderResult is the output of the entry function for a Request, which is
+// JSON encoded, along with the console output captured while rendering it.
+type renderResult struct {
+	output  string
+	console []ConsoleMessage
 }
 
-type responseError struct {
-	resp *Response
-	err  error
+type resultError struct {
+	res *renderResult
+	err error
 }
 
 // NewWorker returns a new Worker with the given server script loaded
 func NewWorker(code string) (*Worker, error) {
-	ctx := v8.NewContext()
+	return NewWorkerWithOptions(code, WorkerOptions{})
+}
+
+// NewWorkerWithOptions returns a new Worker with the given server script
+// loaded and options applied.
+func NewWorkerWithOptions(code string, opts WorkerOptions) (*Worker, error) {
+	return loadWorker(code, opts, nil)
+}
+
+// loadWorker returns a new Worker with the given server script loaded and
+// options applied. If cache is given, it supplies the code cache data for the
+// script unless the options do, and receives the data produced when the
+// script is compiled from source.
+func loadWorker(code string, opts WorkerOptions, cache *blobCache) (*Worker, error) {
+	w := &Worker{
+		id:              atomic.AddInt64(&nextWorkerID, 1),
+		version:         checksum(code),
+		logger:          opts.Logger,
+		capture:         opts.CaptureConsole,
+		sourceMap:       opts.SourceMap,
+		componentErrors: opts.ComponentErrors,
+	}
+
+	w.ctx = v8.NewContextWithOptions(v8.ContextOptions{
+		MaxHeapSize: opts.MaxHeapSize,
+		Snapshot:    opts.Snapshot,
+	})
+
+	if err := w.load(code, opts, cache); err != nil {
+		w.ctx.Release()
+		kind := KindCompile
+		if err == v8.ErrOutOfMemory {
+			kind = KindOutOfMemory
+		}
+		return nil, &RenderError{Kind: kind, Version: w.version, Err: w.sourceMap.rewrite(err)}
+	}
+
+	w.created = time.Now()
+	w.updateHeapStatistics()
+
+	return w, nil
+}
+
+// load installs the host APIs in the worker's context and loads the server
+// script, unless the context was created from a snapshot of it.
+func (w *Worker) load(code string, opts WorkerOptions, cache *blobCache) error {
+	if err := w.installConsole(); err != nil {
+		return err
+	}
 
-	if err := ctx.EvalRelease(code, "server.js"); err != nil {
-		ctx.Release()
+	if opts.EventLoop {
+		loop, err := w.ctx.EventLoop()
+		if err != nil {
+			return err
+		}
+		w.loop = loop
+	}
+
+	if opts.Snapshot == nil {
+		if err := evalServerCode(w.ctx, code, w.version, opts, cache); err != nil {
+			return err
+		}
+	}
+
+	if w.loop != nil {
+		return w.loop.Clear()
+	}
+	return nil
+}
+
+// evalServerCode compiles and runs the server script in ctx, using and
+// producing code cache data as described by loadWorker.
+func evalServerCode(ctx *v8.Context, code, version string, opts WorkerOptions, cache *blobCache) error {
+	script, err := compileServerCode(ctx, code, version, opts, cache)
+	if err != nil {
+		return err
+	}
+	defer script.Release()
+
+	return script.RunRelease()
+}
+
+// compileServerCode compiles the server script in ctx. Workers created at
+// the same time wait for the first to produce the code cache data of the
+// version, so that it is only compiled from source once.
+func compileServerCode(ctx *v8.Context, code, version string, opts WorkerOptions, cache *blobCache) (*v8.Script, error) {
+	copts := v8.CompileOptions{CachedData: opts.CachedData}
+	if cache == nil || len(copts.CachedData) > 0 {
+		return ctx.CompileWithOptions(code, serverScriptName, copts)
+	}
+
+	defer cache.lock(version)()
+
+	copts.CachedData, _ = cache.get(version)
+	copts.ProduceCachedData = len(copts.CachedData) == 0
+
+	script, err := ctx.CompileWithOptions(code, serverScriptName, copts)
+	if err != nil {
 		return nil, err
 	}
+	if data := script.CachedData(); data != nil {
+		cache.put(version, data)
+	} else if script.CachedDataRejected() {
+		cache.remove(version)
+	}
+	return script, nil
+}
 
-	return &Worker{
-		version: checksum(code),
-		ctx:     ctx,
-	}, nil
+// HeapStatistics returns the current heap usage of the worker. It waits for
+// any render in progress to finish.
+func (w *Worker) HeapStatistics() (v8.HeapStatistics, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return v8.HeapStatistics{}, ErrClosed
+	}
+
+	return w.ctx.HeapStatistics()
+}
+
+// lastHeapStatistics returns the heap usage of the worker as of its most
+// recent render.
+func (w *Worker) lastHeapStatistics() v8.HeapStatistics {
+	w.heapMu.Lock()
+	defer w.heapMu.Unlock()
+
+	return w.heap
+}
+
+// updateHeapStatistics records the current heap usage of the worker. The
+// caller must hold the worker lock, or have exclusive use of the worker.
+func (w *Worker) updateHeapStatistics() {
+	hs, err := w.ctx.HeapStatistics()
+	if err != nil {
+		return
+	}
+
+	w.heapMu.Lock()
+	w.heap = hs
+	w.heapMu.Unlock()
 }
 
 // Render renders a React component using the embedded v8 runtime.
 func (w *Worker) Render(req *Request) (*Response, error) {
+	return w.RenderContext(context.Background(), req)
+}
+
+// RenderContext renders a React component using the embedded v8 runtime. If
+// ctx is cancelled or its deadline passes before the render completes, the
+// render is aborted and ctx.Err() is returned. The Request Timeout applies
+// in addition to any deadline on ctx. Errors are returned as a *RenderError.
+func (w *Worker) RenderContext(ctx context.Context, req *Request) (*Response, error) {
+	t := time.Now()
+
+	res, err := w.run(ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Response{}
+	if err := json.Unmarshal([]byte(res.output), resp); err != nil {
+		return nil, w.renderError(KindProtocol, req, err)
+	}
+	resp.Console = res.console
+	resp.Timer = time.Since(t)
+
+	if w.componentErrors && resp.Error != "" {
+		return resp, w.renderError(KindComponent, req, errors.New(resp.Error))
+	}
+	return resp, nil
+}
+
+// RenderInto renders a Request like RenderContext, but decodes the result of
+// the server script into out, which may be any type the JSON it returns can
+// be unmarshaled into, instead of a Response.
+func (w *Worker) RenderInto(ctx context.Context, req *Request, out interface{}) error {
+	res, err := w.run(ctx, req, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(res.output), out); err != nil {
+		return w.renderError(KindProtocol, req, err)
+	}
+	return nil
+}
+
+// RenderStream renders a Request like RenderContext, but calls the global
+// renderStream function of the server script instead of render, passing it
+// the Request and a write function. Each string passed to write is written
+// to out as it is produced, and out is flushed if it has a Flush method, as
+// an http.ResponseWriter or bufio.Writer does. renderStream may return a
+// promise, which is awaited as for render.
+//
+// Nothing is written to out once RenderStream has returned, including after
+// a timeout. If writing to out fails, write throws and the error is returned.
+func (w *Worker) RenderStream(ctx context.Context, req *Request, out io.Writer) error {
+	stream := &streamWriter{w: out}
+	_, err := w.run(ctx, req, stream)
+	if werr := stream.close(); werr != nil {
+		// The script most likely failed because it could not write.
+		return w.renderError(KindProtocol, req, werr)
+	}
+	return err
+}
+
+// run renders the given request, applying its Timeout and aborting the render
+// when ctx is done, as described by RenderContext. If stream is given, the
+// request is rendered as a stream, as described by RenderStream.
+func (w *Worker) run(ctx context.Context, req *Request, stream *streamWriter) (*renderResult, error) {
 	if req.Timeout == 0 {
 		req.Timeout = DefaultTimeout
 	}
 
-	ch := make(chan responseError, 1)
+	rctx, cancel := context.WithTimeout(ctx, req.Timeout)
+	defer cancel()
+
+	ch := make(chan resultError, 1)
 	go func() {
-		resp, err := w.render(req)
-		ch <- responseError{resp: resp, err: err}
+		res, err := w.render(rctx, req, stream)
+		ch <- resultError{res: res, err: err}
 	}()
 
 	select {
 	case re := <-ch:
-		return re.resp, re.err
-	case <-time.After(req.Timeout):
-		return nil, ErrTimedOut
+		if re.err == errAborted {
+			return nil, w.renderError(KindTimeout, req, abortError(ctx))
+		}
+		return re.res, re.err
+	case <-rctx.Done():
+		// The render goroutine terminates the script as soon as it observes
+		// rctx is done, so the worker lock is released promptly for any
+		// subsequent Close.
+		return nil, w.renderError(KindTimeout, req, abortError(ctx))
 	}
 }
 
@@ -70,42 +386,208 @@ func (w *Worker) Close() {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	w.releaseLocked()
+}
+
+// releaseLocked closes the worker and releases its V8 context, along with the
+// write function of streaming renders. The caller must hold the worker lock.
+func (w *Worker) releaseLocked() {
 	w.closed = true
+	if w.write != nil {
+		w.write.Release()
+		w.write = nil
+	}
 	if w.ctx != nil {
 		w.ctx.Release()
 		w.ctx = nil
 	}
 }
 
-// render obtains a lock on the worker and renders the given request
-func (w *Worker) render(req *Request) (*Response, error) {
-	t := time.Now()
+// hasEntryFunction reports whether the server script defines the global
+// function used to render requests.
+func (w *Worker) hasEntryFunction() (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
+	if w.closed {
+		return false, ErrClosed
+	}
+
+	val, err := w.ctx.Eval("typeof "+entryFunction, "")
+	if err != nil {
+		return false, err
+	}
+	defer val.Release()
+
+	return val.String() == "function", nil
+}
+
+// render obtains a lock on the worker and renders the given request, as a
+// stream if stream is given. The entry function may return a promise, in
+// which case its result is awaited. If the script is still running when ctx
+// is done, its execution is terminated and errAborted is returned.
+func (w *Worker) render(ctx context.Context, req *Request, stream *streamWriter) (*renderResult, error) {
 	buf, err := json.Marshal(req)
 	if err != nil {
-		return nil, err
+		return nil, w.renderError(KindProtocol, req, err)
 	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.closed {
-		return nil, ErrClosed
+		return nil, w.renderError(KindClosed, req, ErrClosed)
+	}
+
+	if ctx.Err() != nil {
+		return nil, errAborted
+	}
+
+	entry, args := entryFunction, []interface{}{string(buf)}
+	if stream != nil {
+		if w.write == nil {
+			if w.write, err = w.ctx.NewFunction(w.writeChunk); err != nil {
+				return nil, w.renderError(scriptErrorKind(err), req, err)
+			}
+		}
+		entry, args = streamFunction, append(args, w.write)
+	}
+
+	watchdog := watch(ctx, w.ctx)
+	w.request = req
+	w.captured = nil
+	w.stream = stream
+	val, err := w.ctx.Call(entry, args...)
+	if err == nil && val.IsPromise() {
+		val, err = w.settle(ctx, val)
+	}
+	if w.loop != nil && err != v8.ErrOutOfMemory {
+		// Timers left behind must not run during a later render.
+		if cerr := w.loop.Clear(); err == nil {
+			err = cerr
+		}
+	}
+	watchdog.stop()
+	captured := w.captured
+	w.request = nil
+	w.captured = nil
+	w.stream = nil
+	atomic.AddInt64(&w.renders, 1)
+	w.updateHeapStatistics()
+	if err == v8.ErrTerminated {
+		return nil, errAborted
+	}
+	if err == v8.ErrOutOfMemory {
+		w.releaseLocked()
+		return nil, w.renderError(KindOutOfMemory, req, ErrOutOfMemory)
 	}
-	val, err := w.ctx.Call("render", string(buf))
 	if err != nil {
-		return nil, err
+		return nil, w.renderError(scriptErrorKind(err), req, w.sourceMap.rewrite(err))
+	}
+	res := &renderResult{
+		output:  val.String(),
+		console: captured,
 	}
-	buf = []byte(val.String())
 	val.Release()
 
-	resp := &Response{}
-	if err := json.Unmarshal(buf, resp); err != nil {
-		return nil, err
+	return res, nil
+}
+
+// watchdog terminates the script running in a worker once the context of a
+// render is done, but only until the render stops it, so that it can never
+// terminate a later render on the same worker.
+type watchdog struct {
+	done     chan struct{}
+	finished bool
+	mu       sync.Mutex
+}
+
+// watch starts a watchdog for a render running in v8ctx. It must be stopped
+// before the worker lock is released.
+func watch(ctx context.Context, v8ctx *v8.Context) *watchdog {
+	d := &watchdog{done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Both cases may be ready at once, so check the render is
+			// still executing before terminating it.
+			d.mu.Lock()
+			if !d.finished {
+				v8ctx.TerminateExecution()
+			}
+			d.mu.Unlock()
+		case <-d.done:
+		}
+	}()
+	return d
+}
+
+// stop stops the watchdog. Once it returns, execution is never terminated.
+func (d *watchdog) stop() {
+	d.mu.Lock()
+	d.finished = true
+	d.mu.Unlock()
+	close(d.done)
+}
+
+// writeChunk is the write function passed to the streaming entry function,
+// which writes the given chunk to the stream of the render in progress. It
+// runs during the render, so the worker lock is already held.
+func (w *Worker) writeChunk(args []*v8.Value) (*v8.Value, error) {
+	if w.stream == nil {
+		return nil, fmt.Errorf("write called after %s returned", streamFunction)
 	}
-	resp.Timer = time.Since(t)
+	if len(args) != 1 || !args[0].IsString() {
+		return nil, errors.New("write expects a string")
+	}
+	return nil, w.stream.write(args[0].String())
+}
 
-	return resp, nil
+// renderError returns a RenderError of the given kind for a failure to render
+// req.
+func (w *Worker) renderError(kind ErrorKind, req *Request, err error) error {
+	return &RenderError{
+		Kind:    kind,
+		Version: w.version,
+		Name:    req.Name,
+		Err:     err,
+	}
+}
+
+// settle releases the promise returned by the entry function and returns the
+// value it was fulfilled with, running the event loop, if any, until it
+// settles. A rejected promise is returned as an error, as is a promise which
+// is still pending once nothing is left to settle it.
+func (w *Worker) settle(ctx context.Context, promise *v8.Value) (*v8.Value, error) {
+	defer promise.Release()
+
+	if w.loop != nil {
+		err := w.loop.Run(ctx, func() bool {
+			return promise.PromiseState() != v8.PromisePending
+		})
+		if err != nil && err == ctx.Err() {
+			return nil, errAborted
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	val, err := promise.PromiseResult()
+	if err == v8.ErrPromisePending {
+		return nil, fmt.Errorf("%s returned a promise which did not settle", entryFunction)
+	}
+	return val, err
+}
+
+// abortError returns the error for a render aborted before completion: the
+// caller's context error if it was cancelled, otherwise ErrTimedOut because
+// the Request Timeout elapsed.
+func abortError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrTimedOut
 }
 
 // checksum computes the md5 sum of the given code
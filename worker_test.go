@@ -1,7 +1,18 @@
 package reactor
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/jcoene/reactor/v8"
 )
 
 func TestWorkerEmptyCode(t *testing.T) {
@@ -55,3 +66,441 @@ func TestWorkerRenderClosed(t *testing.T) {
 	assertEquals(t, true, w.closed)
 	assertNil(t, w.ctx)
 }
+
+func TestWorkerRenderTimeoutInfiniteLoop(t *testing.T) {
+	w, err := NewWorker(`function render(json) {
+		if (JSON.parse(json).name === "loop") { while (true) {} }
+		return '{"html": "<div>OK</div>"}';
+	}`)
+	assertNil(t, err)
+	defer w.Close()
+
+	resp, err := w.Render(&Request{Name: "loop", Timeout: 50 * time.Millisecond})
+	assertNil(t, resp)
+	if !errors.Is(err, ErrTimedOut) {
+		t.Fatalf("expected ErrTimedOut, got %v", err)
+	}
+
+	// the worker should be reusable once the runaway render is terminated
+	resp, err = w.Render(&Request{Name: "ok"})
+	if err != nil {
+		t.Fatalf("expected the worker to be reusable, got %v", err)
+	}
+	if resp == nil {
+		t.Fatal("expected a response")
+	}
+	assertContains(t, resp.HTML, "OK")
+}
+
+func TestWorkerRenderContextCancel(t *testing.T) {
+	w, err := NewWorker(`function render() { while (true) {} }`)
+	assertNil(t, err)
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	resp, err := w.RenderContext(ctx, &Request{})
+	assertNil(t, resp)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWorkerOutOfMemory(t *testing.T) {
+	w, err := NewWorkerWithOptions(`function render() {
+		var a = [];
+		while (true) { a.push(new Array(10000).join("x") + a.length); }
+	}`, WorkerOptions{MaxHeapSize: 32 * 1024 * 1024})
+	assertNil(t, err)
+
+	resp, err := w.Render(&Request{Timeout: 30 * time.Second})
+	assertNil(t, resp)
+	if !errors.Is(err, ErrOutOfMemory) {
+		t.Fatalf("expected ErrOutOfMemory, got %v", err)
+	}
+	assertEquals(t, true, w.closed)
+}
+
+func TestWorkerRenderPromise(t *testing.T) {
+	w, err := NewWorker(`
+		function load(name) { return Promise.resolve("<p>" + name + "</p>"); }
+		function render(json) {
+			var req = JSON.parse(json);
+			if (req.name === "Broken") {
+				return Promise.reject(new Error("broken component"));
+			}
+			if (req.name === "Forever") {
+				return new Promise(function() {});
+			}
+			return load(req.name).then(function(html) {
+				return JSON.stringify({ html: html });
+			});
+		}
+	`)
+	assertNil(t, err)
+	defer w.Close()
+
+	resp, err := w.Render(&Request{Name: "Async"})
+	assertNil(t, err)
+	if resp != nil {
+		assertEquals(t, "<p>Async</p>", resp.HTML)
+	}
+
+	resp, err = w.Render(&Request{Name: "Broken"})
+	assertNil(t, resp)
+	assertNotNil(t, err)
+	if err != nil {
+		assertContains(t, err.Error(), "Error: broken component")
+	}
+
+	resp, err = w.Render(&Request{Name: "Forever"})
+	assertNil(t, resp)
+	assertNotNil(t, err)
+	if err != nil {
+		assertContains(t, err.Error(), "did not settle")
+	}
+}
+
+func TestWorkerEventLoop(t *testing.T) {
+	w, err := NewWorkerWithOptions(`
+		var fired = 0;
+		function render(json) {
+			var req = JSON.parse(json);
+			if (req.name === "Delayed") {
+				return new Promise(function(resolve) {
+					setTimeout(function() { resolve(JSON.stringify({ html: "<p>delayed</p>" })); }, 10);
+				});
+			}
+			if (req.name === "Forever") {
+				return new Promise(function() { setInterval(function() {}, 5); });
+			}
+			if (req.name === "Leak") {
+				setTimeout(function() { fired++; }, 0);
+			}
+			return JSON.stringify({ html: "fired " + fired });
+		}
+	`, WorkerOptions{EventLoop: true})
+	assertNil(t, err)
+	defer w.Close()
+
+	resp, err := w.Render(&Request{Name: "Delayed"})
+	assertNil(t, err)
+	if resp != nil {
+		assertEquals(t, "<p>delayed</p>", resp.HTML)
+	}
+
+	resp, err = w.Render(&Request{Name: "Forever", Timeout: 50 * time.Millisecond})
+	assertNil(t, resp)
+	assertEquals(t, true, errors.Is(err, ErrTimedOut))
+
+	// timers are cancelled between renders
+	resp, err = w.Render(&Request{Name: "Leak"})
+	assertNil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	resp, err = w.Render(&Request{Name: "Count"})
+	assertNil(t, err)
+	if resp != nil {
+		assertEquals(t, "fired 0", resp.HTML)
+	}
+}
+
+func TestWorkerConsole(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	code := `
+		console.info("loaded");
+		function render(json) {
+			var req = JSON.parse(json);
+			console.log("rendering %s with %d props", req.name, 2, { a: 1 });
+			console.warn("careful");
+			console.debug("100%% done");
+			return JSON.stringify({ html: "ok" });
+		}
+	`
+	w, err := NewWorkerWithOptions(code, WorkerOptions{Logger: logger, CaptureConsole: true})
+	assertNil(t, err)
+	defer w.Close()
+
+	resp, err := w.Render(&Request{Name: "Widget"})
+	assertNil(t, err)
+	if resp != nil {
+		assertEquals(t, []ConsoleMessage{
+			{Level: "log", Message: `rendering Widget with 2 props {"a":1}`},
+			{Level: "warn", Message: "careful"},
+			{Level: "debug", Message: "100% done"},
+		}, resp.Console)
+	}
+
+	out := buf.String()
+	assertContains(t, out, `level=INFO msg=loaded worker=`)
+	assertContains(t, out, `level=WARN msg=careful worker=`)
+	assertContains(t, out, fmt.Sprintf(`version=%s request=Widget`, checksum(code)))
+	assertContains(t, out, `level=DEBUG msg="100% done"`)
+}
+
+func TestWorkerSourceMap(t *testing.T) {
+	m, err := ParseSourceMap([]byte(testSourceMap))
+	assertNil(t, err)
+
+	w, err := NewWorkerWithOptions(testSourceMapCode, WorkerOptions{SourceMap: m})
+	assertNil(t, err)
+	defer w.Close()
+
+	_, err = w.Render(&Request{})
+	var jsErr *v8.JSError
+	if !errors.As(err, &jsErr) {
+		t.Fatalf("expected *v8.JSError, got %v", err)
+	}
+	assertEquals(t, "src/App.jsx", jsErr.ScriptName)
+	assertEquals(t, 10, jsErr.Line)
+	assertEquals(t, 5, jsErr.Column)
+	assertEquals(t, `    throw new Error("boom");`, jsErr.SourceLine)
+	assertEquals(t, []v8.StackFrame{
+		{Function: "render", ScriptName: "src/App.jsx", Line: 10, Column: 5},
+	}, jsErr.StackFrames)
+	assertContains(t, err.Error(), "Uncaught exception: Error: boom\nat src/App.jsx:10:4")
+	assertContains(t, err.Error(), "at render (src/App.jsx:10:5)")
+	if strings.Contains(err.Error(), serverScriptName) {
+		t.Errorf("unmapped location in %q", err.Error())
+	}
+}
+
+func TestWorkerRenderErrors(t *testing.T) {
+	_, err := NewWorker(`function render() {`)
+	assertEquals(t, true, errors.Is(err, &RenderError{Kind: KindCompile}))
+
+	code := `function render(json) {
+		switch (JSON.parse(json).name) {
+		case "Throw": throw new TypeError("bad props");
+		case "Garbage": return "<div>";
+		case "Loop": while (true) {}
+		}
+		return JSON.stringify({ html: "<p>oops</p>", error: "not found" });
+	}`
+	w, err := NewWorkerWithOptions(code, WorkerOptions{ComponentErrors: true})
+	assertNil(t, err)
+
+	cases := []struct {
+		name string
+		kind ErrorKind
+	}{
+		{"Throw", KindException},
+		{"Garbage", KindProtocol},
+		{"Loop", KindTimeout},
+		{"Missing", KindComponent},
+	}
+	for _, c := range cases {
+		resp, err := w.Render(&Request{Name: c.name, Timeout: 50 * time.Millisecond})
+		var re *RenderError
+		if !errors.As(err, &re) {
+			t.Fatalf("%s: expected *RenderError, got %v", c.name, err)
+		}
+		assertEquals(t, c.kind, re.Kind)
+		assertEquals(t, c.name, re.Name)
+		assertEquals(t, checksum(code), re.Version)
+
+		// component errors are returned along with the response
+		if c.kind == KindComponent {
+			assertNotNil(t, resp)
+			assertEquals(t, "not found", err.Error())
+		} else {
+			assertNil(t, resp)
+		}
+	}
+
+	_, err = w.Render(&Request{Name: "Throw"})
+	var jsErr *v8.JSError
+	assertEquals(t, true, errors.As(err, &jsErr))
+	assertContains(t, err.Error(), "TypeError: bad props")
+
+	w.Close()
+	_, err = w.Render(&Request{})
+	assertEquals(t, true, errors.Is(err, ErrClosed))
+	assertEquals(t, true, errors.Is(err, &RenderError{Kind: KindClosed}))
+}
+
+func TestWorkerResponseFields(t *testing.T) {
+	w, err := NewWorker(`function render() {
+		return JSON.stringify({
+			html: "<p>gone</p>",
+			head: "<title>Not Found</title>",
+			status: 404,
+			redirect: "/home",
+			headers: { "Cache-Control": "no-store", "set-cookie": ["a=1", "b=2"] },
+			extra: { "route": "missing", "ids": [1, 2] },
+		});
+	}`)
+	assertNil(t, err)
+	defer w.Close()
+
+	resp, err := w.Render(&Request{})
+	assertNil(t, err)
+	if resp == nil {
+		t.FailNow()
+	}
+	assertEquals(t, "<p>gone</p>", resp.HTML)
+	assertEquals(t, "<title>Not Found</title>", resp.Head)
+	assertEquals(t, 404, resp.Status)
+	assertEquals(t, "/home", resp.RedirectURL)
+	if got := resp.Headers.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("expected Cache-Control header no-store, got %q", got)
+	}
+	if got := resp.Headers["Set-Cookie"]; len(got) != 2 || got[0] != "a=1" || got[1] != "b=2" {
+		t.Errorf("expected two Set-Cookie headers, got %q", got)
+	}
+	assertEquals(t, `{"route":"missing","ids":[1,2]}`, string(resp.Extra))
+}
+
+func TestWorkerRenderInto(t *testing.T) {
+	w, err := NewWorker(`function render(json) {
+		var req = JSON.parse(json);
+		if (req.name === "Garbage") { return "{"; }
+		return JSON.stringify({ subject: "Hello " + req.props.name, tags: ["welcome"] });
+	}`)
+	assertNil(t, err)
+	defer w.Close()
+
+	var email struct {
+		Subject string   `json:"subject"`
+		Tags    []string `json:"tags"`
+	}
+	err = w.RenderInto(context.Background(), &Request{Name: "Email", Props: map[string]string{"name": "Alfie"}}, &email)
+	assertNil(t, err)
+	assertEquals(t, "Hello Alfie", email.Subject)
+	assertEquals(t, []string{"welcome"}, email.Tags)
+
+	err = w.RenderInto(context.Background(), &Request{Name: "Garbage"}, &email)
+	assertEquals(t, true, errors.Is(err, &RenderError{Kind: KindProtocol}))
+}
+
+// chunkWriter records the chunks written to it and how often it is flushed.
+type chunkWriter struct {
+	chunks  []string
+	flushes int
+	err     error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.chunks = append(w.chunks, string(p))
+	return len(p), nil
+}
+
+func (w *chunkWriter) Flush() {
+	w.flushes++
+}
+
+func TestWorkerRenderStream(t *testing.T) {
+	w, err := NewWorkerWithOptions(`function renderStream(json, write) {
+		var req = JSON.parse(json);
+		if (req.name === "Forever") {
+			return new Promise(function() {
+				setInterval(function() { write("tick"); }, 1);
+			});
+		}
+		write("<div>");
+		return new Promise(function(resolve) {
+			setTimeout(function() {
+				write(req.props.text);
+				write("</div>");
+				resolve();
+			}, 1);
+		});
+	}`, WorkerOptions{EventLoop: true})
+	assertNil(t, err)
+	defer w.Close()
+
+	out := &chunkWriter{}
+	err = w.RenderStream(context.Background(), &Request{Props: map[string]string{"text": "streamed"}}, out)
+	assertNil(t, err)
+	assertEquals(t, []string{"<div>", "streamed", "</div>"}, out.chunks)
+	assertEquals(t, 3, out.flushes)
+
+	// nothing is written once a render times out
+	out = &chunkWriter{}
+	err = w.RenderStream(context.Background(), &Request{Name: "Forever", Timeout: 50 * time.Millisecond}, out)
+	assertEquals(t, true, errors.Is(err, ErrTimedOut))
+	n := len(out.chunks)
+	time.Sleep(20 * time.Millisecond)
+	assertEquals(t, n, len(out.chunks))
+
+	// write errors are returned
+	out = &chunkWriter{err: errors.New("broken pipe")}
+	err = w.RenderStream(context.Background(), &Request{Props: map[string]string{"text": "lost"}}, out)
+	assertEquals(t, true, errors.Is(err, &RenderError{Kind: KindProtocol}))
+	assertNotNil(t, err)
+	if err != nil {
+		assertContains(t, err.Error(), "broken pipe")
+	}
+}
+
+func TestWorkerCloseReleasesWrite(t *testing.T) {
+	w, err := NewWorker(`function renderStream(json, write) { write("ok"); }`)
+	assertNil(t, err)
+
+	assertNil(t, w.RenderStream(context.Background(), &Request{}, &chunkWriter{}))
+	if w.write == nil {
+		t.Fatal("expected the write function to be created")
+	}
+
+	w.Close()
+	if w.write != nil {
+		t.Errorf("expected the write function to be released")
+	}
+}
+
+func TestWorkerRenderDeadlineRace(t *testing.T) {
+	w, err := NewWorker(`function render() { return '{"html": "ok"}'; }`)
+	assertNil(t, err)
+	defer w.Close()
+
+	// renders whose deadline expires as they finish must never terminate
+	// the render which follows them on the same worker
+	for i := 0; i < 500; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i%50)*time.Microsecond)
+		w.RenderContext(ctx, &Request{})
+		cancel()
+
+		resp, err := w.Render(&Request{})
+		if err != nil {
+			t.Fatalf("render %d failed: %v", i, err)
+		}
+		assertEquals(t, "ok", resp.HTML)
+	}
+}
+
+func TestCompileServerCodeOnce(t *testing.T) {
+	code := `function render() { return '{"html": "ok"}'; }`
+	cache := newBlobCache("", ".codecache")
+
+	// only one of the workers created at the same time compiles from source
+	var wg sync.WaitGroup
+	var produced int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := v8.NewContext()
+			defer ctx.Release()
+
+			script, err := compileServerCode(ctx, code, checksum(code), WorkerOptions{}, cache)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if script.CachedData() != nil {
+				atomic.AddInt32(&produced, 1)
+			}
+			script.Release()
+		}()
+	}
+	wg.Wait()
+
+	if produced != 1 {
+		t.Errorf("expected code cache data to be produced once, got %d", produced)
+	}
+}